@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 
 	"github.com/stephane-martin/vssh/commands"
+	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/widgets"
 
 	"github.com/gabriel-vasile/mimetype"
@@ -20,12 +21,19 @@ func App() *cli.App {
 	app.Version = version
 	app.Commands = []cli.Command{
 		commands.SSHCommand(),
+		commands.SSHCompatCommand(),
+		commands.SSHConfigCommand(),
 		commands.SCPCommand(),
 		commands.SFTPCommand(),
+		commands.RsyncCommand(),
 		commands.TopCommand(),
 		commands.BrowseCommand(),
 		commands.TunnelCommand(),
+		commands.NetcatCommand(),
 		commands.ResolveCommand(),
+		commands.CertCommand(),
+		commands.AgentCommand(),
+		commands.ControlCommand(),
 		commands.SocksCommand(),
 		commands.HTTPProxyCommand(),
 		{
@@ -93,9 +101,15 @@ func GlobalFlags() []cli.Flag {
 			EnvVar: "VAULT_TOKEN",
 			Usage:  "Vault authentication token",
 		},
+		cli.StringFlag{
+			Name:   "vault-token-helper",
+			Value:  "",
+			EnvVar: "VAULT_TOKEN_HELPER",
+			Usage:  "program that stores the Vault token (defaults to the token_helper of the Vault CLI configuration, or to ~/.vault-token)",
+		},
 		cli.StringFlag{
 			Name:   "vault-auth-method,vault-method,method",
-			Usage:  "type of authentication",
+			Usage:  "type of authentication [token, userpass, ldap, approle, jwt, kubernetes, cert]",
 			Value:  "token",
 			EnvVar: "VAULT_AUTH_METHOD",
 		},
@@ -117,23 +131,145 @@ func GlobalFlags() []cli.Flag {
 			Value:  "",
 			EnvVar: "VAULT_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "vault-auth-role",
+			Usage:  "role to log in with (jwt, kubernetes and cert auth methods)",
+			Value:  "",
+			EnvVar: "VAULT_AUTH_ROLE",
+		},
+		cli.StringFlag{
+			Name:   "vault-jwt",
+			Usage:  "JWT for the jwt auth method",
+			Value:  "",
+			EnvVar: "VAULT_JWT",
+		},
+		cli.StringFlag{
+			Name:   "vault-jwt-file",
+			Usage:  "file that contains the JWT for the jwt or kubernetes auth methods",
+			Value:  "",
+			EnvVar: "VAULT_JWT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "vault-ca-cert",
+			Usage:  "path to a PEM-encoded CA certificate file to verify the Vault server certificate",
+			EnvVar: "VAULT_CACERT",
+		},
+		cli.StringFlag{
+			Name:   "vault-client-cert",
+			Usage:  "path to a PEM-encoded client certificate for TLS authentication to Vault",
+			EnvVar: "VAULT_CLIENT_CERT",
+		},
+		cli.StringFlag{
+			Name:   "vault-client-key",
+			Usage:  "path to the private key matching the client certificate",
+			EnvVar: "VAULT_CLIENT_KEY",
+		},
+		cli.BoolFlag{
+			Name:   "vault-tls-skip-verify",
+			Usage:  "do not verify the Vault server certificate",
+			EnvVar: "VAULT_SKIP_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "vault-namespace",
+			Usage:  "Vault namespace (Vault Enterprise)",
+			EnvVar: "VAULT_NAMESPACE",
+		},
 		cli.StringFlag{
 			Name:   "vault-ssh-mount,mount",
 			Usage:  "Vault SSH signer mount point",
 			EnvVar: "VAULT_SSH_MOUNT",
 			Value:  "ssh-client-signer",
 		},
+		cli.StringFlag{
+			Name:   "vault-otp-mount,otp-mount",
+			Usage:  "Vault SSH OTP secrets engine mount point (defaults to the signer mount point)",
+			EnvVar: "VAULT_OTP_MOUNT",
+		},
+		cli.StringFlag{
+			Name:   "vault-otp-role,otp-role",
+			Usage:  "Vault SSH OTP role, to log in with a one-time password",
+			EnvVar: "VAULT_OTP_ROLE",
+		},
+		cli.StringFlag{
+			Name:   "vault-ssh-host-mount,host-mount",
+			Usage:  "Vault SSH host signer mount point, used to verify the host certificates",
+			EnvVar: "VAULT_SSH_HOST_MOUNT",
+		},
 		cli.StringFlag{
 			Name:   "vault-ssh-role,role",
 			Usage:  "Vault signing role",
 			EnvVar: "VAULT_SSH_ROLE",
 		},
+		cli.StringFlag{
+			Name:   "cert-ttl",
+			Usage:  "requested TTL of the signed certificate (ex: 5m)",
+			EnvVar: "VSSH_CERT_TTL",
+		},
+		cli.StringFlag{
+			Name:   "cert-key-id",
+			Usage:  "requested key ID of the signed certificate",
+			EnvVar: "VSSH_CERT_KEY_ID",
+		},
+		cli.StringSliceFlag{
+			Name:  "cert-principal",
+			Usage: "additional principal of the signed certificate (multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "cert-extension",
+			Usage: "extension of the signed certificate (multiple times): permit-pty, permit-port-forwarding, permit-agent-forwarding, permit-X11-forwarding, permit-user-rc",
+		},
+		cli.StringFlag{
+			Name:   "cert-force-command",
+			Usage:  "force-command critical option of the signed certificate",
+			EnvVar: "VSSH_CERT_FORCE_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "cert-source-address",
+			Usage:  "source-address critical option of the signed certificate (ex: 10.0.0.0/8)",
+			EnvVar: "VSSH_CERT_SOURCE_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "vssh configuration file, where the profiles are defined",
+			EnvVar: "VSSH_CONFIG",
+			Value:  params.DefaultConfigPath,
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "profile of the configuration file to use, instead of the one that matches the host",
+			EnvVar: "VSSH_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "local-ca",
+			Usage:  "sign the certificates with this CA private key instead of Vault (offline and dev use)",
+			EnvVar: "VSSH_LOCAL_CA",
+		},
 		cli.StringFlag{
 			Name:   "http-proxy,httpproxy",
 			Usage:  "specify a URL to connect through a HTTP proxy",
 			Value:  "",
 			EnvVar: "SSH_HTTP_PROXY",
 		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Usage:  "specify a socks5:// or socks5h:// URL to connect through a SOCKS5 proxy",
+			EnvVar: "VSSH_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "proxy-command",
+			Usage:  "connect through the stdin and stdout of this command, like the ssh_config ProxyCommand (ex: 'nc %h %p')",
+			EnvVar: "VSSH_PROXY_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "control-path",
+			Usage:  "share the connections through a control master on this unix socket (%h, %p, %r and %C are replaced)",
+			EnvVar: "VSSH_CONTROL_PATH",
+		},
+		cli.StringFlag{
+			Name:   "control-persist",
+			Usage:  "keep the control master this long after the last connection closes (no, yes, or a time like 10m)",
+			EnvVar: "VSSH_CONTROL_PERSIST",
+		},
 		cli.StringFlag{
 			Name:   "login,l",
 			Usage:  "SSH remote user",
@@ -141,22 +277,35 @@ func GlobalFlags() []cli.Flag {
 		},
 		cli.IntFlag{
 			Name:   "ssh-port,sshport,P",
-			Usage:  "SSH remote port",
+			Usage:  "SSH remote port (defaults to the ssh_config port, or 22)",
 			EnvVar: "SSH_PORT",
-			Value:  22,
 		},
 		cli.StringFlag{
+			Name:   "jump,J",
+			Usage:  "connect through these jump hosts, as [user@]host[:port] separated by commas",
+			EnvVar: "VSSH_JUMP",
+		},
+		cli.StringFlag{
+			Name:   "ssh-config,F",
+			Usage:  "ssh_config file to read instead of ~/.ssh/config and /etc/ssh/ssh_config (\"none\" to read none)",
+			EnvVar: "VSSH_SSH_CONFIG",
+		},
+		cli.StringSliceFlag{
 			Name:   "privkey,private,identity,i",
-			Usage:  "filesystem path to SSH private key",
+			Usage:  "filesystem path to SSH private key (multiple times, defaults to ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa and ~/.ssh/id_rsa)",
 			EnvVar: "IDENTITY",
-			Value:  "",
 		},
 		cli.StringFlag{
 			Name:   "vprivkey,vprivate,videntity",
-			Usage:  "Vault secret path to SSH private key",
+			Usage:  "Vault secret path to SSH private key, as path#field@version",
 			EnvVar: "VIDENTITY",
 			Value:  "",
 		},
+		cli.BoolFlag{
+			Name:   "ephemeral",
+			Usage:  "generate an in-memory key pair for this session and get it signed by Vault",
+			EnvVar: "VSSH_EPHEMERAL",
+		},
 		cli.BoolFlag{
 			Name:   "insecure",
 			Usage:  "do not check the remote SSH host key",
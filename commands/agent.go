@@ -0,0 +1,376 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/hashicorp/vault/api"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+	"github.com/stephane-martin/vssh/vault"
+
+	"github.com/urfave/cli"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// agentHandoffEnv is set in the environment of the background agent. The
+// agent then reads the Vault token (or the local CA key) and the private keys
+// on fd 3, instead of asking for them, and closes fd 4 when it is ready.
+const agentHandoffEnv = "VSSH_AGENT_HANDOFF"
+
+// agentHandoff is written with crypto.WriteHandoff. The keys are []byte, so
+// that they are not copied to strings that cannot be wiped.
+type agentHandoff struct {
+	// Address is needed as VAULT_ADDR is removed from the environment.
+	Address string   `json:"address,omitempty"`
+	Token   string   `json:"token,omitempty"`
+	CAKey   []byte   `json:"ca_key,omitempty"`
+	Keys    [][]byte `json:"keys"`
+}
+
+func AgentCommand() cli.Command {
+	socketFlag := cli.StringFlag{
+		Name:   "socket,s",
+		Usage:  "path of the agent unix socket",
+		EnvVar: "VSSH_AGENT_SOCK",
+		Value:  "~/.cache/vssh/agent.sock",
+	}
+	return cli.Command{
+		Name:  "agent",
+		Usage: "run a ssh-agent that holds certificates signed by Vault or by the local CA",
+		Subcommands: []cli.Command{
+			{
+				Name:   "start",
+				Usage:  "start the agent in the background",
+				Action: agentStartAction,
+				Flags: []cli.Flag{
+					socketFlag,
+					cli.BoolFlag{
+						Name:  "foreground",
+						Usage: "do not detach the agent",
+					},
+				},
+			},
+			{
+				Name:      "add",
+				Usage:     "sign the keys and add them to the running ssh-agent until the certificates expire",
+				ArgsUsage: "[[login@]host]",
+				Action:    agentAddAction,
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "confirm,c",
+						Usage: "ask the agent to confirm each use of the keys",
+					},
+				},
+			},
+			{
+				Name:   "stop",
+				Usage:  "stop the agent",
+				Action: agentStopAction,
+				Flags:  []cli.Flag{socketFlag},
+			},
+		},
+	}
+}
+
+func agentStartAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+
+	socketPath, err := homedir.Expand(clictx.String("socket"))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	logger, err := params.Logger(strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
+	sshParams, err := certSSHParams(c, logger)
+	if err != nil {
+		return err
+	}
+	vaultParams := vault.GetVaultParams(c)
+	if vaultParams.SSHRole == "" && c.LocalCA() == "" {
+		return errors.New("the agent needs a Vault SSH role or a local CA to sign the certificates")
+	}
+
+	if os.Getenv(agentHandoffEnv) != "" {
+		return runHandedOffAgent(ctx, socketPath, vaultParams, sshParams, logger)
+	}
+
+	sshParams.UseAgent = false
+	client, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
+	if err != nil {
+		return err
+	}
+	var caKey *memguard.LockedBuffer
+	if c.LocalCA() != "" {
+		caKey, err = crypto.ReadLocalCA(c.LocalCA())
+		if err != nil {
+			return err
+		}
+	} else if client == nil {
+		return errors.New("failed to authenticate to Vault")
+	}
+	if clictx.Bool("foreground") {
+		signer, renewToken, err := agentSigner(client, caKey, vaultParams, sshParams, logger)
+		if err != nil {
+			return err
+		}
+		return runAgent(ctx, socketPath, signer, renewToken, credentials, logger, nil)
+	}
+	pid, err := startAgent(client, caKey, credentials)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", sys.EscapeString(socketPath))
+	fmt.Printf("echo Agent pid %d;\n", pid)
+	return nil
+}
+
+// agentSigner returns the signer of the agent certificates: the local CA when
+// its key is given, Vault otherwise. The TokenRenewer is nil for the local CA.
+func agentSigner(client *api.Client, caKey *memguard.LockedBuffer, vaultParams params.VaultParams, sshParams params.SSHParams, l *zap.SugaredLogger) (crypto.CertSigner, crypto.TokenRenewer, error) {
+	if caKey != nil {
+		signer, err := crypto.LocalCertSigner(caKey, sshParams)
+		return signer, nil, err
+	}
+	return crypto.VaultCertSigner(client, vaultParams, sshParams, l)
+}
+
+// startAgent starts the agent in a new session, hands it off the Vault token
+// or the local CA key, and the private keys, and waits until it listens.
+func startAgent(client *api.Client, caKey *memguard.LockedBuffer, credentials []crypto.SSHCredentials) (int, error) {
+	var handoff agentHandoff
+	if caKey != nil {
+		handoff.CAKey = caKey.Buffer()
+	} else {
+		handoff.Address = client.Address()
+		handoff.Token = client.Token()
+	}
+	for _, credential := range credentials {
+		if credential.PrivateKey != nil {
+			handoff.Keys = append(handoff.Keys, credential.PrivateKey.Buffer())
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	handoffR, handoffW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = handoffR.Close() }()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		_ = handoffW.Close()
+		return 0, err
+	}
+	defer func() { _ = readyR.Close() }()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), agentHandoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{handoffR, readyW}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		_ = handoffW.Close()
+		return 0, err
+	}
+	err = crypto.WriteHandoff(handoffW, handoff)
+	_ = handoffW.Close()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return 0, err
+	}
+	status, err := ioutil.ReadAll(readyR)
+	if err != nil {
+		return 0, err
+	}
+	if string(status) != "ok" {
+		_ = cmd.Wait()
+		if len(status) == 0 {
+			return 0, errors.New("the agent failed to start")
+		}
+		return 0, errors.New(string(status))
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+	return pid, nil
+}
+
+func runHandedOffAgent(ctx context.Context, socketPath string, vaultParams params.VaultParams, sshParams params.SSHParams, l *zap.SugaredLogger) error {
+	ready := os.NewFile(4, "ready")
+	defer func() { _ = ready.Close() }()
+	err := func() error {
+		handoffR := os.NewFile(3, "handoff")
+		defer func() { _ = handoffR.Close() }()
+		var handoff agentHandoff
+		err := crypto.ReadHandoff(handoffR, &handoff)
+		if err != nil {
+			return fmt.Errorf("failed to read the agent handoff: %s", err)
+		}
+		defer func() {
+			// the keys that were not moved to locked memory
+			memguard.WipeBytes(handoff.CAKey)
+			for _, k := range handoff.Keys {
+				memguard.WipeBytes(k)
+			}
+		}()
+		var client *api.Client
+		var caKey *memguard.LockedBuffer
+		if len(handoff.CAKey) > 0 {
+			caKey, err = memguard.NewImmutableFromBytes(handoff.CAKey)
+			if err != nil {
+				return err
+			}
+		} else {
+			vaultParams.Address = handoff.Address
+			client, err = vault.NewClient(vaultParams)
+			if err != nil {
+				return err
+			}
+			client.SetToken(handoff.Token)
+		}
+		signer, renewToken, err := agentSigner(client, caKey, vaultParams, sshParams, l)
+		if err != nil {
+			return err
+		}
+		var credentials []crypto.SSHCredentials
+		for _, k := range handoff.Keys {
+			privkey, err := memguard.NewImmutableFromBytes(k)
+			if err != nil {
+				return err
+			}
+			pubkey, err := crypto.DerivePublicKey(privkey)
+			if err != nil {
+				return err
+			}
+			credentials = append(credentials, crypto.SSHCredentials{PrivateKey: privkey, PublicKey: pubkey})
+		}
+		return runAgent(ctx, socketPath, signer, renewToken, credentials, l, ready)
+	}()
+	if err != nil {
+		_, _ = ready.WriteString(err.Error())
+	}
+	return err
+}
+
+// runAgent serves the agent until the context is canceled. The ready file, if
+// any, is closed when the agent listens.
+func runAgent(ctx context.Context, socketPath string, signer crypto.CertSigner, renewToken crypto.TokenRenewer, credentials []crypto.SSHCredentials, l *zap.SugaredLogger, ready *os.File) error {
+	ag, err := crypto.NewCertAgent(credentials, signer, renewToken, l)
+	if err != nil {
+		return err
+	}
+	defer ag.Destroy()
+	listener, err := lib.ListenAgent(socketPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(socketPath) }()
+	pidPath := socketPath + ".pid"
+	err = ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0600)
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	defer func() { _ = os.Remove(pidPath) }()
+
+	// sign the certificates before the agent is used
+	ag.Renew(ctx)
+	go ag.Run(ctx)
+	if ready != nil {
+		_, _ = ready.WriteString("ok")
+		_ = ready.Close()
+	} else {
+		fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", sys.EscapeString(socketPath))
+	}
+	return lib.ServeAgent(ctx, listener, ag, l)
+}
+
+func agentAddAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	credentials, err := signedCredentials(ctx, clictx)
+	if err != nil {
+		return err
+	}
+	var added int
+	for _, credential := range credentials {
+		cert, err := crypto.AddToAgent(credential, clictx.Bool("confirm"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to add certificate to the agent: %s\n", err)
+			continue
+		}
+		added++
+		validity := "forever"
+		if cert.ValidBefore != ssh.CertTimeInfinity {
+			validity = "until " + time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339)
+		}
+		fmt.Printf("added %s (%s), %s\n", ssh.FingerprintSHA256(cert.Key), cert.KeyId, validity)
+	}
+	if added == 0 {
+		return errors.New("no certificate was added to the agent")
+	}
+	return nil
+}
+
+func agentStopAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+
+	socketPath, err := homedir.Expand(clictx.String("socket"))
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(socketPath + ".pid")
+	if err != nil {
+		return fmt.Errorf("no agent is running on %s", socketPath)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return fmt.Errorf("invalid agent pid file: %s", err)
+	}
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
@@ -0,0 +1,173 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+
+	"github.com/urfave/cli"
+	"go.uber.org/zap"
+)
+
+func CertCommand() cli.Command {
+	return cli.Command{
+		Name:  "cert",
+		Usage: "inspect and export the certificate signed by Vault",
+		Subcommands: []cli.Command{
+			{
+				Name:      "show",
+				Usage:     "sign the key and show the certificate",
+				ArgsUsage: "[[login@]host]",
+				Action:    certShowAction,
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the certificate as JSON",
+					},
+				},
+			},
+			{
+				Name:      "export",
+				Usage:     "sign the key and write the key and certificate to disk",
+				ArgsUsage: "[[login@]host]",
+				Action:    certExportAction,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "out,o",
+						Usage: "path of the private key (the public key and the certificate are written next to it)",
+					},
+					cli.BoolFlag{
+						Name:  "force,f",
+						Usage: "overwrite existing files",
+					},
+				},
+			},
+		},
+	}
+}
+
+func certShowAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	credentials, err := signedCredentials(ctx, clictx)
+	if err != nil {
+		return err
+	}
+	info, err := crypto.DescribeCertificate(credentials[0].Certificate)
+	if err != nil {
+		return err
+	}
+	if clictx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	fmt.Print(info.String())
+	return nil
+}
+
+func certExportAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+
+	out := strings.TrimSpace(clictx.String("out"))
+	if out == "" {
+		return errors.New("specify the path of the exported private key")
+	}
+	out, err := homedir.Expand(out)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	credentials, err := signedCredentials(ctx, clictx)
+	if err != nil {
+		return err
+	}
+	credential := credentials[0]
+	paths, err := lib.ExportCredentials(out, credential.PrivateKey, credential.PublicKey, credential.Certificate, clictx.Bool("force"))
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+	return err
+}
+
+// signedCredentials returns the credentials whose certificate was just signed
+// by Vault or by the local CA. The certificates read from the filesystem are
+// left out, as they may be stale. The host argument is optional, as it is only
+// needed to fetch the host CA.
+func signedCredentials(ctx context.Context, clictx *cli.Context) ([]crypto.SSHCredentials, error) {
+	logger, err := params.Logger(strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return nil, err
+	}
+	sshParams, err := certSSHParams(c, logger)
+	if err != nil {
+		return nil, err
+	}
+	sshParams.UseAgent = false
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
+	if err != nil {
+		return nil, err
+	}
+	var signed []crypto.SSHCredentials
+	for _, credential := range credentials {
+		if credential.Signed && credential.PrivateKey != nil {
+			signed = append(signed, credential)
+		}
+	}
+	if len(signed) == 0 {
+		logger.Debugw("no certificate among the credentials", "count", len(credentials))
+		return nil, errors.New("no certificate was signed: check the Vault SSH mount, role and key options")
+	}
+	return signed, nil
+}
+
+func certSSHParams(c params.CLIContext, l *zap.SugaredLogger) (p params.SSHParams, err error) {
+	if c.SSHHost() != "" {
+		p, err = params.GetSSHParams(c, l)
+		// the certificates are not used to connect
+		p.ControlPath = ""
+		return p, err
+	}
+	p.LoginName = c.SSHLogin()
+	if p.LoginName == "" {
+		u, err := user.Current()
+		if err != nil {
+			return p, err
+		}
+		p.LoginName = u.Username
+	}
+	p.Sign, err = params.GetSignParams(c)
+	return p, err
+}
@@ -0,0 +1,400 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/stephane-martin/vssh/params"
+
+	"github.com/urfave/cli"
+)
+
+// The options of the OpenSSH client, without and with an argument.
+const (
+	sshCompatFlags   = "46AaCfGgKkMNnqsTtVvXxYy"
+	sshCompatOptions = "BbcDEeFIiJLlmOoPpQRSWw"
+)
+
+func SSHCompatCommand() cli.Command {
+	return cli.Command{
+		Name:      "ssh-compat",
+		Usage:     "connect like the OpenSSH client, with its options (for GIT_SSH_COMMAND, rsync -e...)",
+		ArgsUsage: "[ssh options] destination [command]",
+		Action:    sshCompatAction,
+		// the arguments are parsed like OpenSSH does
+		SkipFlagParsing: true,
+	}
+}
+
+// SSHConfigCommand prints the ssh_config options of a host, for ssh-compat -G.
+func SSHConfigCommand() cli.Command {
+	return cli.Command{
+		Name:      "ssh-config",
+		Usage:     "print the options that apply to a host, like ssh -G",
+		ArgsUsage: "[login@]host",
+		Action:    sshConfigAction,
+		Hidden:    true,
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "option,o",
+				Usage: "ssh_config option, as Keyword=value, that takes precedence over the ssh_config files (multiple times)",
+			},
+		},
+	}
+}
+
+// sshCompat translates the arguments of the OpenSSH client into the options
+// of vssh ssh.
+type sshCompat struct {
+	global       []string
+	options      []string
+	ssh          []string
+	host         string
+	login        string
+	port         string
+	uriPort      string
+	stdio        string
+	terminal     string
+	subsystem    bool
+	forwardAgent bool
+	printConfig  bool
+	seen         map[string]bool
+}
+
+func sshCompatAction(clictx *cli.Context) error {
+	t := &sshCompat{seen: make(map[string]bool)}
+	command, err := t.parse(clictx.Args())
+	if err != nil {
+		// like ssh
+		return cli.NewExitError("vssh: "+err.Error(), 255)
+	}
+	// the global options of the command line come first, so that the
+	// OpenSSH options take precedence
+	root := clictx.Parent()
+	args := append([]string{}, os.Args[:len(os.Args)-len(root.Args())]...)
+	args = append(args, t.globalArgs()...)
+	if t.printConfig {
+		// -G only prints the configuration: git runs ssh -G to check
+		// that ssh is OpenSSH
+		args = append(args, "ssh-config")
+		args = append(args, t.options...)
+		args = append(args, "--", t.host)
+	} else if t.stdio != "" {
+		// -W forwards stdin and stdout, without a session
+		if len(command) > 0 {
+			return cli.NewExitError("vssh: -W does not take a command", 255)
+		}
+		args = append(args, "netcat")
+		args = append(args, t.options...)
+		args = append(args, "--", t.host, t.stdio)
+	} else {
+		args = append(args, "ssh")
+		args = append(args, t.sshArgs()...)
+		args = append(args, "--", t.host)
+		args = append(args, command...)
+	}
+	// the control master is started with the global options of os.Args
+	os.Args = args
+	return clictx.App.Run(args)
+}
+
+// parse parses the arguments like ssh: the options may also follow the
+// destination, until the command starts.
+func (t *sshCompat) parse(args []string) (command []string, err error) {
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			if t.host != "" {
+				break
+			}
+			err = t.destination(arg)
+			if err != nil {
+				return nil, err
+			}
+			args = args[1:]
+			continue
+		}
+		args, err = t.option(args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.host == "" {
+		if len(args) == 0 {
+			return nil, errors.New("no destination")
+		}
+		err = t.destination(args[0])
+		if err != nil {
+			return nil, err
+		}
+		args = args[1:]
+	}
+	if t.login != "" {
+		// like ssh, -l takes precedence over the login of the destination
+		if i := strings.LastIndex(t.host, "@"); i >= 0 {
+			t.host = t.host[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// destination parses the destination, as [user@]host or
+// ssh://[user@]host[:port].
+func (t *sshCompat) destination(arg string) error {
+	if !strings.HasPrefix(arg, "ssh://") {
+		t.host = arg
+		return nil
+	}
+	u, err := url.Parse(arg)
+	if err != nil || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("invalid destination: %s", arg)
+	}
+	t.host = u.Hostname()
+	if u.User != nil && u.User.Username() != "" {
+		t.host = u.User.Username() + "@" + t.host
+	}
+	t.uriPort = u.Port()
+	return nil
+}
+
+// option parses the options of args[0], that may be grouped like -tt, or
+// followed by their argument like -p2222, and returns the next arguments.
+func (t *sshCompat) option(args []string) ([]string, error) {
+	arg, args := args[0], args[1:]
+	for i := 1; i < len(arg); i++ {
+		opt := arg[i]
+		if strings.IndexByte(sshCompatFlags, opt) >= 0 {
+			err := t.flag(opt)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.IndexByte(sshCompatOptions, opt) < 0 {
+			return nil, fmt.Errorf("unknown option -%c", opt)
+		}
+		value := arg[i+1:]
+		if value == "" {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("option -%c needs an argument", opt)
+			}
+			value, args = args[0], args[1:]
+		}
+		return args, t.optionValue(opt, value)
+	}
+	return args, nil
+}
+
+func (t *sshCompat) flag(opt byte) error {
+	switch opt {
+	case 't':
+		t.terminal = "--terminal"
+	case 'T':
+		t.terminal = "--no-terminal"
+	case 's':
+		t.subsystem = true
+	case 'N':
+		t.ssh = append(t.ssh, "--no-session")
+	case 'A':
+		t.forwardAgent = true
+	case 'a':
+		t.forwardAgent = false
+	case 'v':
+		t.global = append(t.global, "--loglevel", "debug")
+	case 'q':
+		t.global = append(t.global, "--loglevel", "error")
+	case 'G':
+		t.printConfig = true
+	case '4', '6', 'C', 'g', 'K', 'k', 'x', 'y':
+		// no effect with vssh
+	default:
+		return fmt.Errorf("the -%c option is not supported", opt)
+	}
+	return nil
+}
+
+func (t *sshCompat) optionValue(opt byte, value string) error {
+	switch opt {
+	case 'p':
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port: %s", value)
+		}
+		t.port = value
+	case 'l':
+		t.login = value
+	case 'i':
+		t.global = append(t.global, "--privkey", value)
+	case 'J':
+		t.global = append(t.global, "--jump", value)
+	case 'F':
+		t.global = append(t.global, "--ssh-config", value)
+	case 'S':
+		t.global = append(t.global, "--control-path", value)
+	case 'o':
+		return t.configOption(value)
+	case 'W':
+		t.stdio = value
+	case 'L':
+		t.ssh = append(t.ssh, "--local-forward", value)
+	case 'R':
+		t.ssh = append(t.ssh, "--remote-forward", value)
+	case 'D':
+		t.ssh = append(t.ssh, "--dynamic-forward", value)
+	case 'B', 'b', 'c', 'E', 'e', 'm':
+		// no effect with vssh
+	default:
+		return fmt.Errorf("the -%c option is not supported", opt)
+	}
+	return nil
+}
+
+// configOption translates a -o option. The options that vssh takes from
+// ssh_config are given to vssh ssh with --option. Like ssh, the first value
+// of an option is used.
+func (t *sshCompat) configOption(option string) error {
+	end := strings.IndexAny(option, " \t=")
+	if end <= 0 {
+		return fmt.Errorf("invalid option: %s", option)
+	}
+	keyword := strings.ToLower(option[:end])
+	value := strings.TrimSpace(option[end:])
+	value = strings.Trim(strings.TrimSpace(strings.TrimPrefix(value, "=")), `"`)
+	if value == "" {
+		return fmt.Errorf("invalid option: %s", option)
+	}
+	if t.seen[keyword] {
+		return nil
+	}
+	t.seen[keyword] = true
+	switch keyword {
+	case "proxycommand":
+		if !strings.EqualFold(value, "none") {
+			t.global = append(t.global, "--proxy-command", value)
+		}
+	case "controlpath":
+		t.global = append(t.global, "--control-path", value)
+	case "controlpersist":
+		t.global = append(t.global, "--control-persist", value)
+	case "controlmaster":
+		// vssh starts a control master when the control path is given
+	case "stricthostkeychecking":
+		if strings.EqualFold(value, "no") || strings.EqualFold(value, "off") {
+			t.global = append(t.global, "--insecure")
+		}
+	case "forwardagent":
+		t.forwardAgent = !strings.EqualFold(value, "no")
+	case "requesttty":
+		switch strings.ToLower(value) {
+		case "yes", "force":
+			t.terminal = "--terminal"
+		case "no":
+			t.terminal = "--no-terminal"
+		}
+	default:
+		t.options = append(t.options, "--option", option)
+	}
+	return nil
+}
+
+func (t *sshCompat) globalArgs() []string {
+	args := t.global
+	if t.login != "" {
+		args = append(args, "--login", t.login)
+	}
+	// -p takes precedence over the port of a ssh:// destination
+	if t.port != "" {
+		args = append(args, "--ssh-port", t.port)
+	} else if t.uriPort != "" {
+		args = append(args, "--ssh-port", t.uriPort)
+	}
+	return args
+}
+
+func (t *sshCompat) sshArgs() []string {
+	args := append(t.options, t.ssh...)
+	if t.terminal != "" {
+		args = append(args, t.terminal)
+	}
+	if t.subsystem {
+		args = append(args, "--subsystem")
+	}
+	if t.forwardAgent {
+		args = append(args, "--forward-agent")
+	}
+	return args
+}
+
+func sshConfigAction(clictx *cli.Context) (e error) {
+	defer func() { e = exitError(e) }()
+
+	logger, err := params.Logger(strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
+	sshParams, err := params.GetSSHParams(c, logger)
+	if err != nil {
+		return err
+	}
+	return writeSSHConfig(os.Stdout, sshParams)
+}
+
+// writeSSHConfig writes the resolved options of a host in the format of
+// ssh -G: one lower-cased keyword and its value per line.
+func writeSSHConfig(w io.Writer, p params.SSHParams) error {
+	var b strings.Builder
+	option := func(keyword string, value interface{}) {
+		fmt.Fprintf(&b, "%s %v\n", keyword, value)
+	}
+	option("host", p.OriginalHost)
+	option("hostname", p.Host)
+	option("user", p.LoginName)
+	option("port", p.Port)
+	for _, f := range p.IdentityFiles {
+		option("identityfile", f)
+	}
+	if len(p.Jumps) > 0 {
+		jumps := make([]string, 0, len(p.Jumps))
+		for _, jump := range p.Jumps {
+			jumps = append(jumps, fmt.Sprintf("%s@%s:%d", jump.SSH.LoginName, jump.SSH.Host, jump.SSH.Port))
+		}
+		option("proxyjump", strings.Join(jumps, ","))
+	}
+	if p.ProxyCommand != "" {
+		option("proxycommand", p.ProxyCommand)
+	}
+	if p.ControlPath != "" {
+		option("controlpath", p.ControlPath)
+	}
+	option("serveraliveinterval", int(p.ServerAliveInterval.Seconds()))
+	option("serveralivecountmax", p.ServerAliveCountMax)
+	if p.Insecure {
+		option("stricthostkeychecking", "no")
+	} else {
+		option("stricthostkeychecking", "yes")
+	}
+	if p.KnownHostsFiles != nil {
+		if len(p.KnownHostsFiles) == 0 {
+			option("userknownhostsfile", "none")
+		} else {
+			option("userknownhostsfile", strings.Join(p.KnownHostsFiles, " "))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,288 @@
+package commands
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stephane-martin/vssh/params"
+)
+
+func TestSSHCompatParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantCommand []string
+		wantHost    string
+		wantGlobal  []string
+		wantSSH     []string
+		wantStdio   string
+		wantConfig  bool
+	}{
+		{
+			name:     "destination only",
+			args:     []string{"server"},
+			wantHost: "server",
+			wantSSH:  []string{},
+		},
+		{
+			name:        "git",
+			args:        []string{"-o", "SendEnv=GIT_PROTOCOL", "-p", "2222", "git@server", "git-upload-pack 'team/project.git'"},
+			wantCommand: []string{"git-upload-pack 'team/project.git'"},
+			wantHost:    "git@server",
+			wantGlobal:  []string{"--ssh-port", "2222"},
+			wantSSH:     []string{"--option", "SendEnv=GIT_PROTOCOL"},
+		},
+		{
+			name:        "options after the destination",
+			args:        []string{"server", "-p2222", "-tt", "uptime", "-v"},
+			wantCommand: []string{"uptime", "-v"},
+			wantHost:    "server",
+			wantGlobal:  []string{"--ssh-port", "2222"},
+			wantSSH:     []string{"--terminal"},
+		},
+		{
+			name:        "double dash",
+			args:        []string{"-T", "--", "server", "-v"},
+			wantCommand: []string{"-v"},
+			wantHost:    "server",
+			wantSSH:     []string{"--no-terminal"},
+		},
+		{
+			name:       "-l takes precedence over the login of the destination",
+			args:       []string{"-l", "alice", "bob@server"},
+			wantHost:   "server",
+			wantGlobal: []string{"--login", "alice"},
+			wantSSH:    []string{},
+		},
+		{
+			name:       "ssh URI",
+			args:       []string{"ssh://git@server:2222/"},
+			wantHost:   "git@server",
+			wantGlobal: []string{"--ssh-port", "2222"},
+			wantSSH:    []string{},
+		},
+		{
+			name:       "-p takes precedence over the port of the URI",
+			args:       []string{"-p", "2200", "ssh://server:2222"},
+			wantHost:   "server",
+			wantGlobal: []string{"--ssh-port", "2200"},
+			wantSSH:    []string{},
+		},
+		{
+			name:       "grouped flags",
+			args:       []string{"-4CAqN", "-i", "/keys/id", "-J", "bastion", "server"},
+			wantHost:   "server",
+			wantGlobal: []string{"--loglevel", "error", "--privkey", "/keys/id", "--jump", "bastion"},
+			wantSSH:    []string{"--no-session", "--forward-agent"},
+		},
+		{
+			name:     "forwardings and subsystem",
+			args:     []string{"-L", "8080:localhost:80", "-R8022:localhost:22", "-D", "1080", "-s", "server", "sftp"},
+			wantHost: "server",
+			wantSSH: []string{
+				"--local-forward", "8080:localhost:80",
+				"--remote-forward", "8022:localhost:22",
+				"--dynamic-forward", "1080",
+				"--subsystem",
+			},
+			wantCommand: []string{"sftp"},
+		},
+		{
+			name:      "-W",
+			args:      []string{"-W", "db:5432", "bastion"},
+			wantHost:  "bastion",
+			wantSSH:   []string{},
+			wantStdio: "db:5432",
+		},
+		{
+			name:       "-G",
+			args:       []string{"-G", "-F", "/dev/null", "server"},
+			wantHost:   "server",
+			wantGlobal: []string{"--ssh-config", "/dev/null"},
+			wantSSH:    []string{},
+			wantConfig: true,
+		},
+		{
+			name:     "options without effect",
+			args:     []string{"-x", "-c", "aes128-ctr", "-E", "/tmp/log", "-m", "hmac-sha2-256", "server"},
+			wantHost: "server",
+			wantSSH:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &sshCompat{seen: make(map[string]bool)}
+			command, err := c.parse(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(command, tt.wantCommand) && (len(command) > 0 || len(tt.wantCommand) > 0) {
+				t.Errorf("command = %q, want %q", command, tt.wantCommand)
+			}
+			if c.host != tt.wantHost {
+				t.Errorf("host = %q, want %q", c.host, tt.wantHost)
+			}
+			if global := c.globalArgs(); !reflect.DeepEqual(global, tt.wantGlobal) && (len(global) > 0 || len(tt.wantGlobal) > 0) {
+				t.Errorf("global options = %q, want %q", global, tt.wantGlobal)
+			}
+			if ssh := c.sshArgs(); !reflect.DeepEqual(ssh, tt.wantSSH) && (len(ssh) > 0 || len(tt.wantSSH) > 0) {
+				t.Errorf("ssh options = %q, want %q", ssh, tt.wantSSH)
+			}
+			if c.stdio != tt.wantStdio {
+				t.Errorf("stdio = %q, want %q", c.stdio, tt.wantStdio)
+			}
+			if c.printConfig != tt.wantConfig {
+				t.Errorf("print config = %v, want %v", c.printConfig, tt.wantConfig)
+			}
+		})
+	}
+}
+
+func TestSSHCompatParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "no destination", args: []string{"-p", "2222"}},
+		{name: "missing argument", args: []string{"server", "-p"}},
+		{name: "invalid port", args: []string{"-p", "ssh", "server"}},
+		{name: "port out of range", args: []string{"-p70000", "server"}},
+		{name: "unknown option", args: []string{"-Z", "server"}},
+		{name: "unsupported flag", args: []string{"-M", "server"}},
+		{name: "unsupported option", args: []string{"-O", "check", "server"}},
+		{name: "invalid URI", args: []string{"ssh://server/path"}},
+		{name: "invalid -o", args: []string{"-o", "Compression", "server"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &sshCompat{seen: make(map[string]bool)}
+			_, err := c.parse(tt.args)
+			if err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestSSHCompatConfigOption(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      []string
+		wantGlobal   []string
+		wantOptions  []string
+		wantTerminal string
+		wantAgent    bool
+	}{
+		{
+			name:        "other options are given to vssh ssh",
+			options:     []string{"SendEnv=GIT_PROTOCOL", "ServerAliveInterval 30"},
+			wantOptions: []string{"--option", "SendEnv=GIT_PROTOCOL", "--option", "ServerAliveInterval 30"},
+		},
+		{
+			name:       "first value wins",
+			options:    []string{"ProxyCommand=nc %h %p", "proxycommand none", "ControlPath /tmp/a", "ControlPath=/tmp/b"},
+			wantGlobal: []string{"--proxy-command", "nc %h %p", "--control-path", "/tmp/a"},
+		},
+		{
+			name:    "ProxyCommand none",
+			options: []string{"ProxyCommand=none", "ProxyCommand=nc %h %p"},
+		},
+		{
+			name:       "control master",
+			options:    []string{"ControlMaster=auto", "ControlPersist = 10m", `ControlPath="/tmp/cm-%C"`},
+			wantGlobal: []string{"--control-persist", "10m", "--control-path", "/tmp/cm-%C"},
+		},
+		{
+			name:       "StrictHostKeyChecking no",
+			options:    []string{"StrictHostKeyChecking=no"},
+			wantGlobal: []string{"--insecure"},
+		},
+		{
+			name:    "StrictHostKeyChecking accept-new",
+			options: []string{"StrictHostKeyChecking=accept-new"},
+		},
+		{
+			name:      "ForwardAgent",
+			options:   []string{"ForwardAgent=yes"},
+			wantAgent: true,
+		},
+		{
+			name:    "ForwardAgent no",
+			options: []string{"ForwardAgent no"},
+		},
+		{
+			name:         "RequestTTY force",
+			options:      []string{"RequestTTY=force"},
+			wantTerminal: "--terminal",
+		},
+		{
+			name:         "RequestTTY no",
+			options:      []string{"RequestTTY=no", "RequestTTY=yes"},
+			wantTerminal: "--no-terminal",
+		},
+		{
+			name:    "RequestTTY auto",
+			options: []string{"RequestTTY=auto"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &sshCompat{seen: make(map[string]bool)}
+			for _, option := range tt.options {
+				if err := c.configOption(option); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(c.global, tt.wantGlobal) {
+				t.Errorf("global options = %q, want %q", c.global, tt.wantGlobal)
+			}
+			if !reflect.DeepEqual(c.options, tt.wantOptions) {
+				t.Errorf("ssh options = %q, want %q", c.options, tt.wantOptions)
+			}
+			if c.terminal != tt.wantTerminal {
+				t.Errorf("terminal = %q, want %q", c.terminal, tt.wantTerminal)
+			}
+			if c.forwardAgent != tt.wantAgent {
+				t.Errorf("forward agent = %v, want %v", c.forwardAgent, tt.wantAgent)
+			}
+		})
+	}
+}
+
+func TestWriteSSHConfig(t *testing.T) {
+	p := params.SSHParams{
+		OriginalHost:        "alias",
+		Host:                "real.example.org",
+		LoginName:           "alice",
+		Port:                2222,
+		IdentityFiles:       []string{"/keys/a", "/keys/b"},
+		ServerAliveInterval: time.Minute,
+		ServerAliveCountMax: 3,
+		KnownHostsFiles:     []string{},
+		Jumps: []params.Jump{
+			{SSH: params.SSHParams{LoginName: "bob", Host: "bastion", Port: 22}},
+		},
+	}
+	var b bytes.Buffer
+	err := writeSSHConfig(&b, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `host alias
+hostname real.example.org
+user alice
+port 2222
+identityfile /keys/a
+identityfile /keys/b
+proxyjump bob@bastion:22
+serveraliveinterval 60
+serveralivecountmax 3
+stricthostkeychecking yes
+userknownhostsfile none
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
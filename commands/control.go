@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/urfave/cli"
+)
+
+func ControlCommand() cli.Command {
+	return cli.Command{
+		Name:  "control",
+		Usage: "manage the control master of --control-path",
+		Subcommands: []cli.Command{
+			{
+				Name:      "check",
+				Usage:     "check that the control master is running",
+				ArgsUsage: "[login@]host",
+				Action:    controlCheckAction,
+			},
+			{
+				Name:      "exit",
+				Usage:     "ask the control master to exit",
+				ArgsUsage: "[login@]host",
+				Action:    controlExitAction,
+			},
+			{
+				Name:   "master",
+				Usage:  "run the control master (started by the other commands)",
+				Action: controlMasterAction,
+				Hidden: true,
+			},
+		},
+	}
+}
+
+// controlPath returns the control path of the host given on the command line.
+func controlPath(clictx *cli.Context) (string, error) {
+	logger, err := params.Logger(strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = logger.Sync() }()
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return "", err
+	}
+	sshParams, err := params.GetSSHParams(c, logger)
+	if err != nil {
+		return "", err
+	}
+	if sshParams.ControlPath == "" {
+		return "", errors.New("no control path: use --control-path")
+	}
+	return sshParams.ControlPath, nil
+}
+
+func controlCheckAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+	path, err := controlPath(clictx)
+	if err != nil {
+		return err
+	}
+	pid, err := lib.ControlCheck(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("control master running on %s (pid %d)\n", path, pid)
+	return nil
+}
+
+func controlExitAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+	path, err := controlPath(clictx)
+	if err != nil {
+		return err
+	}
+	err = lib.ControlExit(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exit request sent to the control master on %s\n", path)
+	return nil
+}
+
+func controlMasterAction(clictx *cli.Context) (e error) {
+	defer func() {
+		if e != nil {
+			e = cli.NewExitError(e.Error(), 1)
+		}
+	}()
+	if os.Getenv(crypto.ControlHandoffEnv) == "" {
+		return errors.New("the control master is started by the other commands, with --control-path")
+	}
+	ready := os.NewFile(4, "ready")
+	defer func() { _ = ready.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	err := func() error {
+		handoffR := os.NewFile(3, "handoff")
+		err := crypto.ReadControlHandoff(handoffR)
+		_ = handoffR.Close()
+		if err != nil {
+			return err
+		}
+		logger, err := params.Logger(strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))))
+		if err != nil {
+			return err
+		}
+		defer func() { _ = logger.Sync() }()
+
+		c, err := params.NewCliContext(clictx)
+		if err != nil {
+			return err
+		}
+		sshParams, err := params.GetSSHParams(c, logger)
+		if err != nil {
+			return err
+		}
+		socketPath := sshParams.ControlPath
+		if socketPath == "" {
+			return errors.New("no control path")
+		}
+		// the control master connects directly
+		sshParams.ControlPath = ""
+		_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
+		if err != nil {
+			return err
+		}
+		methods := crypto.CredentialsToMethods(credentials, logger)
+		if len(methods) == 0 {
+			return errors.New("no usable credentials")
+		}
+		cfg := gssh.Config{
+			User:      sshParams.LoginName,
+			Host:      sshParams.Host,
+			Port:      sshParams.Port,
+			Auth:      methods,
+			HTTPProxy: sshParams.HTTPProxy,
+		}
+		hkcb, err := crypto.MakeHostKeyCallback(sshParams, logger)
+		if err != nil {
+			return err
+		}
+		cfg.HostKey = hkcb
+		client, err := lib.Dial(ctx, cfg, sshParams, logger)
+		if err != nil {
+			return err
+		}
+		return lib.ServeControl(ctx, client, socketPath, sshParams.ControlPersist, ready, logger)
+	}()
+	if err != nil {
+		_, _ = ready.WriteString(err.Error())
+	}
+	return err
+}
@@ -42,6 +42,10 @@ func SCPGetCommand() cli.Command {
 				Name:  "preserve,p",
 				Usage: "preserves modification times, access times, and modes from the original file",
 			},
+			cli.BoolFlag{
+				Name:  "native",
+				Usage: "use the native scp client instead of the builtin one",
+			},
 		},
 		Action: wrapGet(false),
 	}
@@ -74,11 +78,7 @@ type getFunc func(context.Context, []string, params.SSHParams, []ssh.AuthMethod,
 
 func wrapGet(sftp bool) cli.ActionFunc {
 	return func(clictx *cli.Context) (e error) {
-		defer func() {
-			if e != nil {
-				e = cli.NewExitError(e.Error(), 1)
-			}
-		}()
+		defer func() { e = exitError(e) }()
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -125,16 +125,38 @@ func wrapGet(sftp bool) cli.ActionFunc {
 		if len(clictx.Args()) == 0 {
 			return errors.New("no host provided")
 		}
-		c := params.NewCliContext(clictx)
-		sshParams, err := params.GetSSHParams(c)
+		c, err := params.NewCliContext(clictx)
+		if err != nil {
+			return err
+		}
+		sshParams, err := params.GetSSHParams(c, logger)
 		if err != nil {
 			return err
 		}
 
+		if clictx.Bool("native") {
+			// the native client does not use the control master
+			sshParams.ControlPath = ""
+			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
+			if err != nil {
+				return err
+			}
+			args := []string{"-r"}
+			if clictx.Bool("preserve") {
+				args = append(args, "-p")
+			}
+			args = append(args, "--")
+			for _, source := range sources {
+				args = append(args, ":"+source)
+			}
+			args = append(args, dest)
+			return lib.NativeSCP(ctx, sshParams, gparams.LogLevel == DEBUG, credentials, args, logger)
+		}
+
 		if len(sources) == 0 {
 			var paths []entry
 
-			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 			if err != nil {
 				return err
 			}
@@ -172,7 +194,7 @@ func wrapGet(sftp bool) cli.ActionFunc {
 			}
 		}
 
-		_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+		_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 		if err != nil {
 			return err
 		}
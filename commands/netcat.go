@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/urfave/cli"
+)
+
+func NetcatCommand() cli.Command {
+	return cli.Command{
+		Name:      "netcat",
+		Usage:     "connect stdin and stdout to a target reached by the SSH server (for ProxyCommand)",
+		ArgsUsage: "[login@]host target (host:port, or the path of a unix socket)",
+		Action:    netcatAction,
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "option,o",
+				Usage: "ssh_config option, as Keyword=value, that takes precedence over the ssh_config files (multiple times)",
+			},
+		},
+	}
+}
+
+// netcatTarget returns the network and the address of the target: the paths
+// of unix sockets contain a slash.
+func netcatTarget(target string) (network, addr string, err error) {
+	if strings.Contains(target, "/") {
+		return "unix", target, nil
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", "", errors.New("the target must be host:port, or the path of a unix socket")
+	}
+	return "tcp", target, nil
+}
+
+func netcatAction(clictx *cli.Context) (e error) {
+	defer func() { e = exitError(e) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	gparams := params.Params{
+		LogLevel: strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))),
+	}
+
+	logger, err := params.Logger(gparams.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	if len(clictx.Args()) != 2 {
+		return errors.New("usage: vssh netcat [login@]host target")
+	}
+	network, addr, err := netcatTarget(clictx.Args()[1])
+	if err != nil {
+		return err
+	}
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
+	sshParams, err := params.GetSSHParams(c, logger)
+	if err != nil {
+		return err
+	}
+	sshParams.Sign.DefaultExtensions(params.PermitPortForwarding)
+
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
+	if err != nil {
+		return err
+	}
+	methods := crypto.CredentialsToMethods(credentials, logger)
+	if len(methods) == 0 {
+		return errors.New("no usable credentials")
+	}
+
+	cfg := gssh.Config{
+		User:      sshParams.LoginName,
+		Host:      sshParams.Host,
+		Port:      sshParams.Port,
+		Auth:      methods,
+		HTTPProxy: sshParams.HTTPProxy,
+	}
+	hkcb, err := crypto.MakeHostKeyCallback(sshParams, logger)
+	if err != nil {
+		return err
+	}
+	cfg.HostKey = hkcb
+	client, err := lib.Dial(ctx, cfg, sshParams, logger)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Close() }()
+	return lib.Netcat(ctx, client, network, addr, logger)
+}
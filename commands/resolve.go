@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/remoteops"
 	"github.com/stephane-martin/vssh/sys"
@@ -60,7 +61,10 @@ func resolveAction(clictx *cli.Context) (e error) {
 	}
 	defer func() { _ = logger.Sync() }()
 
-	c := params.NewCliContext(clictx)
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
 	if c.SSHHost() == "" {
 		var err error
 		c, err = widgets.Form(c, true)
@@ -69,12 +73,13 @@ func resolveAction(clictx *cli.Context) (e error) {
 		}
 	}
 
-	sshParams, err := params.GetSSHParams(c)
+	sshParams, err := params.GetSSHParams(c, logger)
 	if err != nil {
 		return err
 	}
+	sshParams.Sign.DefaultExtensions(params.PermitPortForwarding)
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 	if err != nil {
 		return err
 	}
@@ -90,12 +95,12 @@ func resolveAction(clictx *cli.Context) (e error) {
 		Auth:      methods,
 		HTTPProxy: sshParams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
+	hkcb, err := crypto.MakeHostKeyCallback(sshParams, logger)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, cfg, sshParams, logger)
 	if err != nil {
 		return err
 	}
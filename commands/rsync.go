@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+
+	"github.com/urfave/cli"
+)
+
+func RsyncCommand() cli.Command {
+	return cli.Command{
+		Name:      "rsync",
+		Usage:     "synchronize files with rsync over the native ssh client using Vault for authentication",
+		ArgsUsage: "[login@]host [rsync options] source... destination (the remote paths start with a colon)",
+		Action:    rsyncAction,
+		// the arguments after the host are given to rsync
+		SkipFlagParsing: true,
+	}
+}
+
+func rsyncAction(clictx *cli.Context) (e error) {
+	defer func() { e = exitError(e) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys.CancelOnSignal(cancel)
+
+	gparams := params.Params{
+		LogLevel: strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))),
+	}
+
+	logger, err := params.Logger(gparams.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	if len(clictx.Args()) < 2 {
+		return errors.New("usage: vssh rsync [login@]host [rsync options] source... destination")
+	}
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
+	sshParams, err := params.GetSSHParams(c, logger)
+	if err != nil {
+		return err
+	}
+	// the native client does not use the control master
+	sshParams.ControlPath = ""
+
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
+	if err != nil {
+		return err
+	}
+	return lib.NativeRsync(ctx, sshParams, gparams.LogLevel == DEBUG, credentials, sshParams.Commands, logger)
+}
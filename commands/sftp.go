@@ -63,7 +63,10 @@ func BrowseCommand() cli.Command {
 			}
 			defer func() { _ = logger.Sync() }()
 
-			c := params.NewCliContext(clictx)
+			c, err := params.NewCliContext(clictx)
+			if err != nil {
+				return err
+			}
 			if c.SSHHost() == "" {
 				var err error
 				c, err = widgets.Form(c, false)
@@ -71,7 +74,7 @@ func BrowseCommand() cli.Command {
 					return err
 				}
 			}
-			sshParams, err := params.GetSSHParams(c)
+			sshParams, err := params.GetSSHParams(c, logger)
 			if err != nil {
 				return err
 			}
@@ -80,7 +83,7 @@ func BrowseCommand() cli.Command {
 			defer cancel()
 			sys.CancelOnSignal(cancel)
 
-			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 			if err != nil {
 				return err
 			}
@@ -144,12 +147,14 @@ func SFTPCommand() cli.Command {
 	return cli.Command{
 		Name:  "sftp",
 		Usage: "download/upload files with sftp protocol using Vault for authentication",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "native",
+				Usage: "use the native sftp client instead of the builtin shell",
+			},
+		},
 		Action: func(clictx *cli.Context) (e error) {
-			defer func() {
-				if e != nil {
-					e = cli.NewExitError(e.Error(), 1)
-				}
-			}()
+			defer func() { e = exitError(e) }()
 
 			gparams := params.Params{
 				LogLevel: strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))),
@@ -165,7 +170,10 @@ func SFTPCommand() cli.Command {
 			defer cancel()
 			sys.CancelOnSignal(cancel)
 
-			c := params.NewCliContext(clictx)
+			c, err := params.NewCliContext(clictx)
+			if err != nil {
+				return err
+			}
 			if c.SSHHost() == "" {
 				var err error
 				c, err = widgets.Form(c, false)
@@ -173,15 +181,24 @@ func SFTPCommand() cli.Command {
 					return err
 				}
 			}
-			sshParams, err := params.GetSSHParams(c)
+			sshParams, err := params.GetSSHParams(c, logger)
 			if err != nil {
 				return err
 			}
+			native := clictx.Bool("native")
+			if native {
+				// the native client does not use the control master
+				sshParams.ControlPath = ""
+			}
 
-			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+			_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 			if err != nil {
 				return err
 			}
+			if native {
+				// the remaining arguments are the options of sftp
+				return lib.NativeSFTP(ctx, sshParams, gparams.LogLevel == DEBUG, credentials, sshParams.Commands, logger)
+			}
 			methods := crypto.CredentialsToMethods(credentials, logger)
 			if len(methods) == 0 {
 				return errors.New("no usable credentials")
@@ -361,17 +378,20 @@ func SFTPCommand() cli.Command {
 					}
 					defer func() { _ = logger.Sync() }()
 
-					c := params.NewCliContext(clictx)
+					c, err := params.NewCliContext(clictx)
+					if err != nil {
+						return err
+					}
 					if c.SSHHost() == "" {
 						return errors.New("no host provided")
 					}
 
-					sshParams, err := params.GetSSHParams(c)
+					sshParams, err := params.GetSSHParams(c, logger)
 					if err != nil {
 						return err
 					}
 
-					_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+					_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 					if err != nil {
 						return err
 					}
@@ -433,16 +453,19 @@ func SFTPCommand() cli.Command {
 					}
 					defer func() { _ = logger.Sync() }()
 
-					c := params.NewCliContext(clictx)
+					c, err := params.NewCliContext(clictx)
+					if err != nil {
+						return err
+					}
 					if c.SSHHost() == "" {
 						return errors.New("no host provided")
 					}
-					sshParams, err := params.GetSSHParams(c)
+					sshParams, err := params.GetSSHParams(c, logger)
 					if err != nil {
 						return err
 					}
 
-					_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+					_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 					if err != nil {
 						return err
 					}
@@ -3,18 +3,15 @@ package commands
 import (
 	"context"
 	"errors"
-	"io/ioutil"
 	"net"
 	"strings"
 
 	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/remoteops"
 	"github.com/stephane-martin/vssh/sys"
 
-	"github.com/getlantern/go-socks5"
-	"github.com/getlantern/golog"
-	"github.com/getlantern/hidden"
 	gssh "github.com/stephane-martin/golang-ssh"
 	"github.com/urfave/cli"
 )
@@ -60,17 +57,21 @@ func socksAction(clictx *cli.Context) (e error) {
 	}
 	defer func() { _ = logger.Sync() }()
 
-	c := params.NewCliContext(clictx)
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
 	if c.SSHHost() == "" {
 		return errors.New("specify SSH host")
 	}
 
-	sshParams, err := params.GetSSHParams(c)
+	sshParams, err := params.GetSSHParams(c, logger)
 	if err != nil {
 		return err
 	}
+	sshParams.Sign.DefaultExtensions(params.PermitPortForwarding)
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 	if err != nil {
 		return err
 	}
@@ -86,12 +87,12 @@ func socksAction(clictx *cli.Context) (e error) {
 		Auth:      methods,
 		HTTPProxy: sshParams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
+	hkcb, err := crypto.MakeHostKeyCallback(sshParams, logger)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, cfg, sshParams, logger)
 	if err != nil {
 		return err
 	}
@@ -111,35 +112,11 @@ func socksAction(clictx *cli.Context) (e error) {
 	}
 	resolver := remoteops.NewResolver(client, dnsServer, logger)
 
-	socksConfig := socks5.Config{
-		Resolver: resolver,
-		Dial: func(_ context.Context, network, addr string) (net.Conn, error) {
-			return client.Dial(network, addr)
-		},
-	}
-	golog.SetOutputs(ioutil.Discard, ioutil.Discard)
-	golog.RegisterReporter(func(err error, linePrefix string, severity golog.Severity, ctx map[string]interface{}) {
-		kv := make([]interface{}, 0, 2*len(ctx)+2)
-		kv = append(kv, "error", hidden.Clean(err.Error()))
-		for k, v := range ctx {
-			kv = append(kv, k, v)
-		}
-		logger.Debugw("socks error", kv...)
-	})
-
-	socksServer, err := socks5.New(&socksConfig)
-	if err != nil {
-		return err
-	}
 	socksAddr := clictx.String("socksaddr")
 	listener, err := net.Listen("tcp", socksAddr)
 	if err != nil {
 		return err
 	}
 	logger.Infow("SOCKS server listening", "addr", socksAddr)
-	go func() {
-		<-ctx.Done()
-		_ = listener.Close()
-	}()
-	return socksServer.Serve(listener)
+	return lib.ServeSOCKS(ctx, client, listener, resolver, logger)
 }
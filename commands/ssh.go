@@ -3,18 +3,20 @@ package commands
 import (
 	"context"
 	"errors"
-	"os"
-	"os/signal"
+	"fmt"
+	"os/exec"
 	"strings"
-	"syscall"
 
 	"github.com/stephane-martin/vssh/crypto"
 	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
 	"github.com/stephane-martin/vssh/vault"
 	"github.com/stephane-martin/vssh/widgets"
 
+	"github.com/awnumar/memguard"
 	"github.com/stephane-martin/vssh/lib"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
@@ -37,9 +39,41 @@ func SSHCommand() cli.Command {
 				Usage:  "force pseudo-terminal allocation",
 				EnvVar: "SSH_FORCE_PSEUDO",
 			},
+			cli.BoolFlag{
+				Name:  "no-terminal,T",
+				Usage: "disable pseudo-terminal allocation, even without a remote command",
+			},
+			cli.BoolFlag{
+				Name:  "subsystem,s",
+				Usage: "run the remote command as a subsystem, like sftp",
+			},
+			cli.BoolFlag{
+				Name:  "forward-agent,A",
+				Usage: "forward the local SSH agent to the remote host",
+			},
+			cli.StringSliceFlag{
+				Name:  "local-forward,L",
+				Usage: "forward a local port or socket to the remote side, as [bind_address:]port:host:hostport (multiple times)",
+			},
+			cli.StringSliceFlag{
+				Name:  "remote-forward,R",
+				Usage: "forward a remote port or socket to the local side, as [bind_address:]port:host:hostport (multiple times)",
+			},
+			cli.StringSliceFlag{
+				Name:  "dynamic-forward,D",
+				Usage: "run a local SOCKS5 server that connects through the remote side, as [bind_address:]port (multiple times)",
+			},
+			cli.BoolFlag{
+				Name:  "no-session,N",
+				Usage: "only forward the ports, without a remote command or shell",
+			},
+			cli.StringSliceFlag{
+				Name:  "option,o",
+				Usage: "ssh_config option, as Keyword=value, that takes precedence over the ssh_config files (multiple times)",
+			},
 			cli.StringSliceFlag{
 				Name:  "secret,key",
-				Usage: "path of a secret to be read from Vault (multiple times)",
+				Usage: "path of a secret to be read from Vault, as path#field@version (multiple times)",
 			},
 			cli.BoolFlag{
 				Name:   "upcase,up",
@@ -51,31 +85,51 @@ func SSHCommand() cli.Command {
 				Usage:  "prefix the environment variable keys with names of secrets",
 				EnvVar: "PREFIX",
 			},
+			cli.StringSliceFlag{
+				Name:  "secret-file",
+				Usage: "write a secret to a remote file while the command runs, as ref:path[:mode] (multiple times)",
+			},
+			cli.StringFlag{
+				Name:   "secret-mode",
+				Usage:  "how secrets are passed to the remote command [env, setenv, stdin]",
+				Value:  params.SecretModeEnv,
+				EnvVar: "VSSH_SECRET_MODE",
+			},
 		},
 	}
 }
 
+// exitError returns the error to exit with: the exit status of the remote
+// command or of the native client, like ssh, or else 1.
+func exitError(e error) error {
+	switch err := e.(type) {
+	case nil:
+		return nil
+	case *ssh.ExitError:
+		return cli.NewExitError("", err.ExitStatus())
+	case *exec.ExitError:
+		return cli.NewExitError("", err.ExitCode())
+	default:
+		return cli.NewExitError(e.Error(), 1)
+	}
+}
+
 func sshAction(clictx *cli.Context) (e error) {
-	defer func() {
-		if e != nil {
-			e = cli.NewExitError(e.Error(), 1)
-		}
-	}()
+	defer func() { e = exitError(e) }()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// a remote command without a pseudo-terminal takes over the signals
+	ctx, cancel := sys.SignalContext(context.Background())
 	defer cancel()
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		for range sigchan {
-			cancel()
-		}
-	}()
 
 	gparams := params.Params{
-		LogLevel: strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))),
-		Prefix:   clictx.Bool("prefix"),
-		Upcase:   clictx.Bool("upcase"),
+		LogLevel:   strings.ToLower(strings.TrimSpace(clictx.GlobalString("loglevel"))),
+		Prefix:     clictx.Bool("prefix"),
+		Upcase:     clictx.Bool("upcase"),
+		SecretMode: strings.ToLower(strings.TrimSpace(clictx.String("secret-mode"))),
+	}
+	err := params.CheckSecretMode(gparams.SecretMode)
+	if err != nil {
+		return err
 	}
 
 	logger, err := params.Logger(gparams.LogLevel)
@@ -84,7 +138,10 @@ func sshAction(clictx *cli.Context) (e error) {
 	}
 	defer func() { _ = logger.Sync() }()
 
-	c := params.NewCliContext(clictx)
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
 	if c.SSHHost() == "" {
 		var err error
 		c, err = widgets.Form(c, true)
@@ -93,12 +150,57 @@ func sshAction(clictx *cli.Context) (e error) {
 		}
 	}
 
-	sshParams, err := params.GetSSHParams(c)
+	sshParams, err := params.GetSSHParams(c, logger)
 	if err != nil {
 		return err
 	}
+	sshParams.NoTerminal = clictx.Bool("no-terminal")
+	sshParams.Subsystem = clictx.Bool("subsystem")
+	sshParams.ForwardAgent = clictx.Bool("forward-agent")
+	sshParams.NoSession = clictx.Bool("no-session")
+	if sshParams.NoSession && len(sshParams.Commands) > 0 {
+		return errors.New("no remote command with --no-session")
+	}
+	for _, forward := range []struct{ typ, flag string }{
+		{params.LocalForward, "local-forward"},
+		{params.RemoteForward, "remote-forward"},
+		{params.DynamicForward, "dynamic-forward"},
+	} {
+		for _, spec := range clictx.StringSlice(forward.flag) {
+			fwd, err := params.ParseForward(forward.typ, spec)
+			if err != nil {
+				return err
+			}
+			sshParams.Forwards = append(sshParams.Forwards, fwd)
+		}
+	}
+	var extensions []string
+	if (c.ForceTerminal() || len(sshParams.Commands) == 0) && !sshParams.NoTerminal && !sshParams.NoSession {
+		extensions = append(extensions, params.PermitPTY)
+	}
+	if len(sshParams.Forwards) > 0 {
+		extensions = append(extensions, params.PermitPortForwarding)
+	}
+	if sshParams.ForwardAgent {
+		extensions = append(extensions, params.PermitAgentForwarding)
+	}
+	sshParams.Sign.DefaultExtensions(extensions...)
+	native := clictx.Bool("native")
+	if native {
+		// the native client does not use the control master
+		sshParams.ControlPath = ""
+	}
 
-	client, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	var secretFiles []params.SecretFile
+	for _, spec := range clictx.StringSlice("secret-file") {
+		f, err := params.ParseSecretFile(spec)
+		if err != nil {
+			return err
+		}
+		secretFiles = append(secretFiles, f)
+	}
+
+	client, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 	if err != nil {
 		return err
 	}
@@ -109,18 +211,39 @@ func sshAction(clictx *cli.Context) (e error) {
 	}
 
 	secretPaths := clictx.StringSlice("secret")
-	var secrets map[string]string
-	if len(secretPaths) > 0 {
-		if client == nil {
-			return errors.New("can't read secrets from vault: no vault client")
+	secrets := params.Secrets{Mode: gparams.SecretMode}
+	if client == nil && (len(secretPaths) > 0 || len(secretFiles) > 0) {
+		// the credentials did not need Vault, like the control master, the
+		// agent or the local CA, but the secrets do
+		client, err = vault.GetVaultClient(ctx, vault.GetVaultParams(c), logger)
+		if err != nil {
+			return fmt.Errorf("can't read secrets from vault: %s", err)
 		}
+	}
+	if len(secretPaths) > 0 {
 		res, err := vault.GetSecretsFromVault(ctx, client, secretPaths, gparams.Prefix, gparams.Upcase, logger)
 		if err != nil {
 			return err
 		}
-		secrets = res
+		secrets.Env = res
+	}
+	for _, f := range secretFiles {
+		v, err := vault.ReadSecretValue(ctx, client, f.Ref, "", logger)
+		if err != nil {
+			return err
+		}
+		b := []byte(v)
+		f.Content, err = memguard.NewImmutableFromBytes(b)
+		if err != nil {
+			memguard.WipeBytes(b)
+			return err
+		}
+		defer f.Content.Destroy()
+		secrets.Files = append(secrets.Files, f)
 	}
 
-	// TODO: restore native connect
+	if native {
+		return lib.NativeConnect(ctx, sshParams, c.ForceTerminal(), gparams.LogLevel == DEBUG, credentials, secrets, logger)
+	}
 	return lib.GoConnectAuth(ctx, sshParams, c.ForceTerminal(), methods, secrets, logger)
 }
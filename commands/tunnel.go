@@ -3,17 +3,15 @@ package commands
 import (
 	"context"
 	"errors"
-	"io"
-	"net"
 	"strings"
 
 	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/lib"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/sys"
 
 	gssh "github.com/stephane-martin/golang-ssh"
 	"github.com/urfave/cli"
-	"golang.org/x/sync/errgroup"
 )
 
 func TunnelCommand() cli.Command {
@@ -85,17 +83,21 @@ func localTunnelAction(clictx *cli.Context) (e error) {
 	}
 	defer func() { _ = logger.Sync() }()
 
-	c := params.NewCliContext(clictx)
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
 	if c.SSHHost() == "" {
 		return errors.New("specify SSH host")
 	}
 
-	sshParams, err := params.GetSSHParams(c)
+	sshParams, err := params.GetSSHParams(c, logger)
 	if err != nil {
 		return err
 	}
+	sshParams.Sign.DefaultExtensions(params.PermitPortForwarding)
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 	if err != nil {
 		return err
 	}
@@ -111,73 +113,31 @@ func localTunnelAction(clictx *cli.Context) (e error) {
 		Auth:      methods,
 		HTTPProxy: sshParams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
+	hkcb, err := crypto.MakeHostKeyCallback(sshParams, logger)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, cfg, sshParams, logger)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	listener, err := net.Listen("tcp", local)
+	fwd := params.Forward{
+		Type:           params.LocalForward,
+		Spec:           local + ":" + remote,
+		ListenNetwork:  "tcp",
+		ListenAddr:     local,
+		ConnectNetwork: "tcp",
+		ConnectAddr:    remote,
+	}
+	listener, err := lib.ListenForward(client, fwd)
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
 	logger.Infow("listening on local address", "address", local)
-	g, lctx := errgroup.WithContext(ctx)
-
-	g.Go(func() error {
-		<-lctx.Done()
-		return listener.Close()
-	})
-
-	g.Go(func() error {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				return err
-			}
-			logger.Infow("accepted a new local connection", "client", conn.RemoteAddr().String())
-			g.Go(func() error {
-				<-lctx.Done()
-				return conn.Close()
-			})
-			g.Go(func() error {
-				remoteConn, err := client.Dial("tcp", remote)
-				if err != nil {
-					logger.Warnw("failed to dial the remote service", "error", err)
-					_ = conn.Close()
-					return nil
-				}
-				logger.Debug("successfully opened a connection to the remote side")
-				_ = handleLocalConn(conn, remoteConn)
-				logger.Infow("closed local connection", "client", conn.RemoteAddr().String())
-				return nil
-			})
-		}
-	})
-
-	err = g.Wait()
-	if err == context.Canceled {
-		return nil
-	}
-	return err
-}
-
-func handleLocalConn(localConn net.Conn, remoteConn net.Conn) error {
-	go func() {
-		// copy what the server sends to the local socket
-		_, _ = io.Copy(localConn, remoteConn)
-		_ = localConn.Close()
-	}()
-	// copy the incoming local data to the remote server
-	_, _ = io.Copy(remoteConn, localConn)
-	_ = remoteConn.Close()
-	return nil
+	return lib.ServeForward(ctx, client, fwd, listener, logger)
 }
 
 func remoteTunnelAction(clictx *cli.Context) (e error) {
@@ -210,17 +170,21 @@ func remoteTunnelAction(clictx *cli.Context) (e error) {
 	}
 	defer func() { _ = logger.Sync() }()
 
-	c := params.NewCliContext(clictx)
+	c, err := params.NewCliContext(clictx)
+	if err != nil {
+		return err
+	}
 	if c.SSHHost() == "" {
 		return errors.New("specify SSH host")
 	}
 
-	sshParams, err := params.GetSSHParams(c)
+	sshParams, err := params.GetSSHParams(c, logger)
 	if err != nil {
 		return err
 	}
+	sshParams.Sign.DefaultExtensions(params.PermitPortForwarding)
 
-	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+	_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 	if err != nil {
 		return err
 	}
@@ -236,71 +200,29 @@ func remoteTunnelAction(clictx *cli.Context) (e error) {
 		Auth:      methods,
 		HTTPProxy: sshParams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, logger)
+	hkcb, err := crypto.MakeHostKeyCallback(sshParams, logger)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.Dial(ctx, cfg)
+	client, err := lib.Dial(ctx, cfg, sshParams, logger)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	listener, err := client.Listen("tcp", remote)
+	fwd := params.Forward{
+		Type:           params.RemoteForward,
+		Spec:           remote + ":" + local,
+		ListenNetwork:  "tcp",
+		ListenAddr:     remote,
+		ConnectNetwork: "tcp",
+		ConnectAddr:    local,
+	}
+	listener, err := lib.ListenForward(client, fwd)
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
 	logger.Infow("listening on remote address", "address", remote)
-	g, lctx := errgroup.WithContext(ctx)
-
-	g.Go(func() error {
-		<-lctx.Done()
-		return listener.Close()
-	})
-
-	g.Go(func() error {
-		for {
-			remoteConn, err := listener.Accept()
-			if err != nil {
-				return err
-			}
-			logger.Infow("accepted a new remote connection", "client", remoteConn.RemoteAddr().String())
-			g.Go(func() error {
-				<-lctx.Done()
-				return remoteConn.Close()
-			})
-			g.Go(func() error {
-				localConn, err := net.Dial("tcp", local)
-				if err != nil {
-					logger.Warnw("failed to dial the local service", "error", err)
-					_ = remoteConn.Close()
-					return nil
-				}
-				logger.Debug("successfully opened a connection to the local side")
-				_ = handleRemoteConn(localConn, remoteConn)
-				logger.Infow("closed remote connection", "client", remoteConn.RemoteAddr().String())
-				return nil
-			})
-		}
-	})
-
-	err = g.Wait()
-	if err == context.Canceled {
-		return nil
-	}
-	return err
-}
-
-func handleRemoteConn(localConn net.Conn, remoteConn net.Conn) error {
-	go func() {
-		// copy back
-		_, _ = io.Copy(remoteConn, localConn)
-		_ = remoteConn.Close()
-	}()
-	// copy the incoming local data to the remote server
-	_, _ = io.Copy(localConn, remoteConn)
-	_ = localConn.Close()
-	return nil
+	return lib.ServeForward(ctx, client, fwd, listener, logger)
 }
@@ -33,6 +33,10 @@ func SCPPutCommand() cli.Command {
 				Usage: "file path on the remote server",
 				Value: ".",
 			},
+			cli.BoolFlag{
+				Name:  "native",
+				Usage: "use the native scp client instead of the builtin one",
+			},
 		},
 		Action: wrapPut(lib.ScpPutAuth),
 	}
@@ -78,11 +82,7 @@ type entry struct {
 
 func wrapPut(f putFunc) cli.ActionFunc {
 	return func(clictx *cli.Context) (e error) {
-		defer func() {
-			if e != nil {
-				e = cli.NewExitError(e.Error(), 1)
-			}
-		}()
+		defer func() { e = exitError(e) }()
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -102,13 +102,21 @@ func wrapPut(f putFunc) cli.ActionFunc {
 			return errors.New("no host provided")
 		}
 
-		c := params.NewCliContext(clictx)
-		sshParams, err := params.GetSSHParams(c)
+		c, err := params.NewCliContext(clictx)
+		if err != nil {
+			return err
+		}
+		sshParams, err := params.GetSSHParams(c, logger)
 		if err != nil {
 			return err
 		}
+		native := clictx.Bool("native")
+		if native {
+			// the native client does not use the control master
+			sshParams.ControlPath = ""
+		}
 
-		_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams.LoginName, sshParams.UseAgent, logger)
+		_, credentials, err := crypto.GetSSHCredentials(ctx, c, sshParams, logger)
 		if err != nil {
 			return err
 		}
@@ -132,6 +140,17 @@ func wrapPut(f putFunc) cli.ActionFunc {
 			}
 		}
 
+		dest := strings.TrimSpace(clictx.String("destination"))
+		if dest == "" {
+			dest = "."
+		}
+
+		if native {
+			args := append([]string{"-r", "--"}, sourcesNames...)
+			args = append(args, ":"+dest)
+			return lib.NativeSCP(ctx, sshParams, gparams.LogLevel == DEBUG, credentials, args, logger)
+		}
+
 		sources := make([]lib.Source, 0, len(sourcesNames))
 		for _, name := range sourcesNames {
 			s, err := lib.MakeSource(name)
@@ -141,11 +160,6 @@ func wrapPut(f putFunc) cli.ActionFunc {
 			sources = append(sources, s)
 		}
 
-		dest := strings.TrimSpace(clictx.String("destination"))
-		if dest == "" {
-			dest = "."
-		}
-
 		return f(ctx, sources, dest, sshParams, methods, logger)
 	}
 }
@@ -0,0 +1,398 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/hashicorp/vault/api"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/vault"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// CertSigner signs a public key and returns the certificate in the
+// authorized_keys format.
+type CertSigner func(ctx context.Context, pub *PublicKey) (*memguard.LockedBuffer, error)
+
+// TokenRenewer renews the Vault token of a CertSigner when it is close to
+// expiry, and returns its remaining TTL, or 0 when it never expires.
+type TokenRenewer func(ctx context.Context) (time.Duration, error)
+
+// VaultCertSigner returns a CertSigner that uses the Vault SSH secrets engine,
+// and the TokenRenewer of its Vault token. The Vault token is moved to locked
+// memory, and is only set on the client while a request is made.
+func VaultCertSigner(clt *api.Client, vaultParams params.VaultParams, sshParams params.SSHParams, l *zap.SugaredLogger) (CertSigner, TokenRenewer, error) {
+	token, err := memguard.NewImmutableFromBytes([]byte(clt.Token()))
+	if err != nil {
+		return nil, nil, err
+	}
+	clt.ClearToken()
+	var mu sync.Mutex
+	renew := func(ctx context.Context) (time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		clt.SetToken(string(token.Buffer()))
+		defer clt.ClearToken()
+		return vault.RenewToken(ctx, clt, l)
+	}
+	sign := func(ctx context.Context, pub *PublicKey) (*memguard.LockedBuffer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		clt.SetToken(string(token.Buffer()))
+		defer clt.ClearToken()
+		_, err := vault.RenewToken(ctx, clt, l)
+		if err != nil {
+			return nil, fmt.Errorf("the Vault token is not valid anymore: %s", err)
+		}
+		return Sign(ctx, pub, sshParams.LoginName, vaultParams.SSHMount, vaultParams.SSHRole, sshParams.Sign, clt, l)
+	}
+	return sign, renew, nil
+}
+
+// retryDelay is the delay before a failed certificate or token renewal is
+// retried.
+const retryDelay = time.Minute
+
+// minTokenCheck is the shortest delay between two checks of the Vault token.
+const minTokenCheck = 10 * time.Second
+
+var errAgentLocked = errors.New("agent: locked")
+
+type agentKey struct {
+	privkey *memguard.LockedBuffer
+	pubkey  ssh.PublicKey
+	cert    *ssh.Certificate
+}
+
+// CertAgent is a ssh-agent that keeps the private keys in locked memory, and
+// offers them with certificates that are renewed before they expire.
+type CertAgent struct {
+	mu         sync.Mutex
+	keys       []*agentKey
+	sign       CertSigner
+	renewToken TokenRenewer
+	locked     bool
+	passphrase []byte
+	logger     *zap.SugaredLogger
+}
+
+// NewCertAgent returns an agent for the private keys of the given credentials.
+// renewToken keeps the Vault token of the signer valid, and is nil when the
+// signer does not use Vault.
+func NewCertAgent(credentials []SSHCredentials, sign CertSigner, renewToken TokenRenewer, l *zap.SugaredLogger) (*CertAgent, error) {
+	a := &CertAgent{sign: sign, renewToken: renewToken, logger: l}
+	for _, credential := range credentials {
+		if credential.PrivateKey == nil || credential.PublicKey == nil {
+			continue
+		}
+		// the public key must not point to the locked buffer, that may be destroyed
+		pubkey, err := ssh.ParsePublicKey(append([]byte(nil), credential.PublicKey.Buffer()...))
+		if err != nil {
+			return nil, err
+		}
+		if a.find(pubkey.Marshal()) != nil {
+			continue
+		}
+		a.keys = append(a.keys, &agentKey{privkey: credential.PrivateKey, pubkey: pubkey})
+	}
+	if len(a.keys) == 0 {
+		return nil, errors.New("no private key to hold in the agent")
+	}
+	return a, nil
+}
+
+// Run renews the certificates, and the Vault token, until the context is
+// canceled.
+func (a *CertAgent) Run(ctx context.Context) {
+	if a.renewToken != nil {
+		go a.keepToken(ctx)
+	}
+	for {
+		next := a.Renew(ctx)
+		a.logger.Debugw("next certificate renewal", "at", next)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// keepToken renews the Vault token before it expires, so that the
+// certificates can still be signed when the token TTL is shorter than the
+// certificate TTL. The token is checked again when half of its remaining TTL
+// has passed, and renewed when it is close to expiry.
+func (a *CertAgent) keepToken(ctx context.Context) {
+	for {
+		ttl, err := a.renewToken(ctx)
+		var next time.Duration
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			a.logger.Errorw("the Vault token is not usable, the certificates may not be renewed", "error", err)
+			next = retryDelay
+		case ttl == 0:
+			// the token never expires
+			return
+		default:
+			next = ttl / 2
+			if next < minTokenCheck {
+				next = minTokenCheck
+			}
+		}
+		a.logger.Debugw("next Vault token check", "in", next)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// Renew signs the keys whose certificate is missing or about to expire, and
+// returns the time of the next renewal.
+func (a *CertAgent) Renew(ctx context.Context) time.Time {
+	a.mu.Lock()
+	keys := append([]*agentKey(nil), a.keys...)
+	a.mu.Unlock()
+
+	now := time.Now()
+	next := now.Add(24 * time.Hour)
+	for _, k := range keys {
+		a.mu.Lock()
+		cert := k.cert
+		a.mu.Unlock()
+		if cert != nil && renewAt(cert).After(now) {
+			if renewAt(cert).Before(next) {
+				next = renewAt(cert)
+			}
+			continue
+		}
+		cert, err := a.signKey(ctx, k.pubkey)
+		if err != nil {
+			a.logger.Warnw("failed to renew certificate", "key", ssh.FingerprintSHA256(k.pubkey), "error", err)
+			if retry := now.Add(retryDelay); retry.Before(next) {
+				next = retry
+			}
+			continue
+		}
+		a.mu.Lock()
+		k.cert = cert
+		a.mu.Unlock()
+		a.logger.Infow("certificate renewed", "key", ssh.FingerprintSHA256(k.pubkey), "valid_before", time.Unix(int64(cert.ValidBefore), 0))
+		if renewAt(cert).Before(next) {
+			next = renewAt(cert)
+		}
+	}
+	return next
+}
+
+func (a *CertAgent) signKey(ctx context.Context, pubkey ssh.PublicKey) (*ssh.Certificate, error) {
+	pubBuf, err := memguard.NewImmutableFromBytes(pubkey.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	defer pubBuf.Destroy()
+	signed, err := a.sign(ctx, (*PublicKey)(pubBuf))
+	if err != nil {
+		return nil, err
+	}
+	defer signed.Destroy()
+	return gssh.ParseCertificate(signed.Buffer())
+}
+
+// renewAt returns when a certificate should be renewed: a tenth of its
+// lifetime before it expires, but at least 30 seconds and at most 5 minutes
+// before.
+func renewAt(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Now().Add(24 * time.Hour)
+	}
+	before := time.Unix(int64(cert.ValidBefore), 0)
+	margin := before.Sub(time.Unix(int64(cert.ValidAfter), 0)) / 10
+	if margin < 30*time.Second {
+		margin = 30 * time.Second
+	} else if margin > 5*time.Minute {
+		margin = 5 * time.Minute
+	}
+	return before.Add(-margin)
+}
+
+func certValid(cert *ssh.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	now := uint64(time.Now().Unix())
+	return now >= cert.ValidAfter && (cert.ValidBefore == ssh.CertTimeInfinity || now < cert.ValidBefore)
+}
+
+func (a *CertAgent) find(blob []byte) *agentKey {
+	for _, k := range a.keys {
+		if bytes.Equal(k.pubkey.Marshal(), blob) {
+			return k
+		}
+		if k.cert != nil && bytes.Equal(k.cert.Marshal(), blob) {
+			return k
+		}
+	}
+	return nil
+}
+
+// List returns the valid certificates, followed by the plain public keys.
+func (a *CertAgent) List() ([]*agent.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return nil, nil
+	}
+	var keys []*agent.Key
+	for _, k := range a.keys {
+		if certValid(k.cert) {
+			keys = append(keys, &agent.Key{
+				Format:  k.cert.Type(),
+				Blob:    k.cert.Marshal(),
+				Comment: "vault certificate " + k.cert.KeyId,
+			})
+		}
+	}
+	for _, k := range a.keys {
+		keys = append(keys, &agent.Key{
+			Format:  k.pubkey.Type(),
+			Blob:    k.pubkey.Marshal(),
+			Comment: ssh.FingerprintSHA256(k.pubkey),
+		})
+	}
+	return keys, nil
+}
+
+// Sign signs data with the private key of the given public key or certificate.
+func (a *CertAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs data, with the RSA SHA-2 algorithms if requested.
+func (a *CertAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return nil, errAgentLocked
+	}
+	k := a.find(key.Marshal())
+	if k == nil {
+		return nil, errors.New("agent: key not found")
+	}
+	signer, err := ssh.ParsePrivateKey(k.privkey.Buffer())
+	if err != nil {
+		return nil, err
+	}
+	if flags == 0 {
+		return signer.Sign(rand.Reader, data)
+	}
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("agent: signature does not support non-default signature algorithm: %T", signer)
+	}
+	switch flags {
+	case agent.SignatureFlagRsaSha256:
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2256)
+	case agent.SignatureFlagRsaSha512:
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	default:
+		return nil, fmt.Errorf("agent: unsupported signature flags: %d", flags)
+	}
+}
+
+// Signers returns signers for the valid certificates and the private keys.
+func (a *CertAgent) Signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return nil, errAgentLocked
+	}
+	var signers []ssh.Signer
+	var certSigners []ssh.Signer
+	for _, k := range a.keys {
+		signer, err := ssh.ParsePrivateKey(k.privkey.Buffer())
+		if err != nil {
+			return nil, err
+		}
+		if certValid(k.cert) {
+			certSigner, err := ssh.NewCertSigner(k.cert, signer)
+			if err != nil {
+				return nil, err
+			}
+			certSigners = append(certSigners, certSigner)
+		}
+		signers = append(signers, signer)
+	}
+	return append(certSigners, signers...), nil
+}
+
+// Add is not supported: the agent only holds the keys it was started with.
+func (a *CertAgent) Add(key agent.AddedKey) error {
+	return errors.New("agent: the vssh agent does not accept new keys")
+}
+
+// Remove is not supported: the agent only holds the keys it was started with.
+func (a *CertAgent) Remove(key ssh.PublicKey) error {
+	return errors.New("agent: the vssh agent does not remove keys, stop it instead")
+}
+
+// RemoveAll is not supported: the agent only holds the keys it was started with.
+func (a *CertAgent) RemoveAll() error {
+	return errors.New("agent: the vssh agent does not remove keys, stop it instead")
+}
+
+// Lock locks the agent with a passphrase.
+func (a *CertAgent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errAgentLocked
+	}
+	a.locked = true
+	a.passphrase = append([]byte(nil), passphrase...)
+	return nil
+}
+
+// Unlock unlocks the agent.
+func (a *CertAgent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.locked {
+		return errors.New("agent: not locked")
+	}
+	if len(passphrase) != len(a.passphrase) || subtle.ConstantTimeCompare(passphrase, a.passphrase) != 1 {
+		return errors.New("agent: incorrect passphrase")
+	}
+	a.locked = false
+	memguard.WipeBytes(a.passphrase)
+	a.passphrase = nil
+	return nil
+}
+
+// Extension is not supported.
+func (a *CertAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// Destroy wipes the private keys.
+func (a *CertAgent) Destroy() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, k := range a.keys {
+		k.privkey.Destroy()
+	}
+	a.keys = nil
+}
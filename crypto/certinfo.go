@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// CertificateInfo describes a SSH certificate.
+type CertificateInfo struct {
+	Type            string            `json:"type"`
+	KeyType         string            `json:"key_type"`
+	Fingerprint     string            `json:"fingerprint"`
+	CAFingerprint   string            `json:"ca_fingerprint"`
+	KeyID           string            `json:"key_id"`
+	Serial          uint64            `json:"serial"`
+	Principals      []string          `json:"principals"`
+	ValidAfter      *time.Time        `json:"valid_after,omitempty"`
+	ValidBefore     *time.Time        `json:"valid_before,omitempty"`
+	CriticalOptions map[string]string `json:"critical_options"`
+	Extensions      map[string]string `json:"extensions"`
+}
+
+// DescribeCertificate parses a certificate in the authorized_keys format.
+func DescribeCertificate(cert *memguard.LockedBuffer) (CertificateInfo, error) {
+	c, err := gssh.ParseCertificate(cert.Buffer())
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	info := CertificateInfo{
+		Type:            "user",
+		KeyType:         c.Key.Type(),
+		Fingerprint:     ssh.FingerprintSHA256(c.Key),
+		CAFingerprint:   ssh.FingerprintSHA256(c.SignatureKey),
+		KeyID:           c.KeyId,
+		Serial:          c.Serial,
+		Principals:      c.ValidPrincipals,
+		CriticalOptions: c.CriticalOptions,
+		Extensions:      c.Extensions,
+	}
+	if c.CertType == ssh.HostCert {
+		info.Type = "host"
+	}
+	if c.ValidAfter != 0 {
+		t := time.Unix(int64(c.ValidAfter), 0)
+		info.ValidAfter = &t
+	}
+	if c.ValidBefore != ssh.CertTimeInfinity {
+		t := time.Unix(int64(c.ValidBefore), 0)
+		info.ValidBefore = &t
+	}
+	return info, nil
+}
+
+// String formats the certificate description like ssh-keygen -L.
+func (i CertificateInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Type: %s %s certificate\n", i.KeyType, i.Type)
+	fmt.Fprintf(&b, "Public key: %s\n", i.Fingerprint)
+	fmt.Fprintf(&b, "Signing CA: %s\n", i.CAFingerprint)
+	fmt.Fprintf(&b, "Key ID: %q\n", i.KeyID)
+	fmt.Fprintf(&b, "Serial: %d\n", i.Serial)
+	validity := "forever"
+	switch {
+	case i.ValidAfter != nil && i.ValidBefore != nil:
+		validity = fmt.Sprintf("from %s to %s", i.ValidAfter.Format(time.RFC3339), i.ValidBefore.Format(time.RFC3339))
+	case i.ValidAfter != nil:
+		validity = fmt.Sprintf("after %s", i.ValidAfter.Format(time.RFC3339))
+	case i.ValidBefore != nil:
+		validity = fmt.Sprintf("before %s", i.ValidBefore.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Valid: %s\n", validity)
+	b.WriteString("Principals:")
+	writeList(&b, i.Principals)
+	b.WriteString("Critical Options:")
+	writeMap(&b, i.CriticalOptions)
+	b.WriteString("Extensions:")
+	writeMap(&b, i.Extensions)
+	return b.String()
+}
+
+func writeList(b *strings.Builder, values []string) {
+	if len(values) == 0 {
+		b.WriteString(" (none)\n")
+		return
+	}
+	b.WriteString("\n")
+	for _, v := range values {
+		fmt.Fprintf(b, "        %s\n", v)
+	}
+}
+
+func writeMap(b *strings.Builder, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if v != "" {
+			k = fmt.Sprintf("%s %s", k, v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeList(b, keys)
+}
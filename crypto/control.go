@@ -0,0 +1,213 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+)
+
+// ControlHandoffEnv is set in the environment of the control master. The
+// control master then reads the credentials of the destination and of the
+// jump hosts on fd 3, instead of asking for them, and writes "ok" on fd 4
+// when it listens.
+const ControlHandoffEnv = "VSSH_CONTROL_HANDOFF"
+
+// controlMasterTimeout is how long to wait for the control master to connect
+// to the SSH server.
+const controlMasterTimeout = time.Minute
+
+// handoffCredential is written with WriteHandoff. The secrets are []byte, so
+// that they are not copied to strings that cannot be wiped.
+type handoffCredential struct {
+	PrivateKey  []byte `json:"private_key,omitempty"`
+	Certificate []byte `json:"certificate,omitempty"`
+	Password    []byte `json:"password,omitempty"`
+	Interactive bool   `json:"interactive,omitempty"`
+	Agent       bool   `json:"agent,omitempty"`
+}
+
+// controlHandoff holds the credentials of each host, by login@host:port.
+type controlHandoff struct {
+	Hosts map[string][]handoffCredential `json:"hosts"`
+}
+
+var handedOff = struct {
+	sync.Mutex
+	hosts map[string][]SSHCredentials
+}{}
+
+func handoffKey(sshParams params.SSHParams) string {
+	return sshParams.LoginName + "@" + net.JoinHostPort(sshParams.Host, strconv.Itoa(sshParams.Port))
+}
+
+// ReadControlHandoff reads the credentials handed off to the control master.
+// GetSSHCredentials then returns them for their hosts.
+func ReadControlHandoff(r io.Reader) error {
+	var handoff controlHandoff
+	err := ReadHandoff(r, &handoff)
+	if err != nil {
+		return fmt.Errorf("failed to read the control master handoff: %s", err)
+	}
+	defer wipeHandoff(handoff)
+	hosts := make(map[string][]SSHCredentials, len(handoff.Hosts))
+	for host, creds := range handoff.Hosts {
+		for _, h := range creds {
+			var c SSHCredentials
+			c.Interactive = h.Interactive
+			c.Agent = h.Agent
+			if len(h.PrivateKey) > 0 {
+				c.PrivateKey, err = memguard.NewImmutableFromBytes(h.PrivateKey)
+				if err != nil {
+					return err
+				}
+				c.PublicKey, err = DerivePublicKey(c.PrivateKey)
+				if err != nil {
+					return err
+				}
+			}
+			if len(h.Certificate) > 0 {
+				c.Certificate, err = memguard.NewImmutableFromBytes(h.Certificate)
+				if err != nil {
+					return err
+				}
+			}
+			if len(h.Password) > 0 {
+				c.Password, err = memguard.NewImmutableFromBytes(h.Password)
+				if err != nil {
+					return err
+				}
+			}
+			hosts[host] = append(hosts[host], c)
+		}
+	}
+	handedOff.Lock()
+	handedOff.hosts = hosts
+	handedOff.Unlock()
+	return nil
+}
+
+// wipeHandoff wipes the secrets that were not moved to locked memory.
+func wipeHandoff(handoff controlHandoff) {
+	for _, creds := range handoff.Hosts {
+		for _, h := range creds {
+			memguard.WipeBytes(h.PrivateKey)
+			memguard.WipeBytes(h.Certificate)
+			memguard.WipeBytes(h.Password)
+		}
+	}
+}
+
+func handedOffCredentials(sshParams params.SSHParams) ([]SSHCredentials, bool) {
+	handedOff.Lock()
+	defer handedOff.Unlock()
+	credentials, ok := handedOff.hosts[handoffKey(sshParams)]
+	return credentials, ok
+}
+
+// ControlMasterRunning tells whether a control master listens on the socket.
+func ControlMasterRunning(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// StartControlMaster starts the control master in a new session, hands it off
+// the credentials of the destination and of the jump hosts, and waits until it
+// is connected and listens.
+func StartControlMaster(ctx context.Context, clictx params.CLIContext, sshParams params.SSHParams, credentials []SSHCredentials, l *zap.SugaredLogger) error {
+	handoff := controlHandoff{Hosts: make(map[string][]handoffCredential)}
+	handoff.Hosts[handoffKey(sshParams)] = toHandoff(credentials)
+	for _, jump := range sshParams.Jumps {
+		_, jumpCredentials, err := GetSSHCredentials(ctx, jump.Context, jump.SSH, l)
+		if err != nil {
+			return fmt.Errorf("jump host %s: %s", jump.SSH.Host, err)
+		}
+		handoff.Hosts[handoffKey(jump.SSH)] = toHandoff(jumpCredentials)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	handoffR, handoffW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = handoffR.Close() }()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		_ = handoffW.Close()
+		return err
+	}
+	defer func() { _ = readyR.Close() }()
+
+	cmd := exec.Command(exe, clictx.ControlMasterArgs()...)
+	cmd.Env = append(os.Environ(), ControlHandoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{handoffR, readyW}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		_ = handoffW.Close()
+		return err
+	}
+	err = WriteHandoff(handoffW, handoff)
+	_ = handoffW.Close()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	_ = readyR.SetReadDeadline(time.Now().Add(controlMasterTimeout))
+	status, err := ioutil.ReadAll(readyR)
+	if err != nil || string(status) != "ok" {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if err != nil {
+			return err
+		}
+		if len(status) == 0 {
+			return errors.New("the control master failed to start")
+		}
+		return errors.New(string(status))
+	}
+	l.Debugw("control master started", "pid", cmd.Process.Pid, "path", sshParams.ControlPath)
+	_ = cmd.Process.Release()
+	return nil
+}
+
+func toHandoff(credentials []SSHCredentials) []handoffCredential {
+	handoff := make([]handoffCredential, 0, len(credentials))
+	for _, c := range credentials {
+		var h handoffCredential
+		if c.PrivateKey != nil {
+			h.PrivateKey = c.PrivateKey.Buffer()
+		}
+		if c.Certificate != nil {
+			h.Certificate = c.Certificate.Buffer()
+		}
+		if c.Password != nil {
+			h.Password = c.Password.Buffer()
+		}
+		h.Interactive = c.Interactive
+		h.Agent = c.Agent
+		handoff = append(handoff, h)
+	}
+	return handoff
+}
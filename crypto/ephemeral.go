@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// GenerateEphemeralKey generates a new ed25519 key pair. The private key is
+// returned in the openssh-key-v1 format, and only lives in locked memory.
+func GenerateEphemeralKey() (*memguard.LockedBuffer, *PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer memguard.WipeBytes(priv)
+	public, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubBytes := public.Marshal()
+	pubBuf, err := memguard.NewImmutableFromBytes(pubBytes)
+	if err != nil {
+		memguard.WipeBytes(pubBytes)
+		return nil, nil, err
+	}
+	privBytes, err := marshalED25519PrivateKey(pub, priv)
+	if err != nil {
+		pubBuf.Destroy()
+		return nil, nil, err
+	}
+	privBuf, err := memguard.NewImmutableFromBytes(privBytes)
+	if err != nil {
+		memguard.WipeBytes(privBytes)
+		pubBuf.Destroy()
+		return nil, nil, err
+	}
+	return privBuf, (*PublicKey)(pubBuf), nil
+}
+
+// EphemeralCredentials generates an ephemeral key pair and gets it signed by
+// Vault or by the local CA.
+func EphemeralCredentials(ctx context.Context, sign CertSigner) (SSHCredentials, error) {
+	if sign == nil {
+		return SSHCredentials{}, errors.New("ephemeral keys must be signed, but there is neither a Vault client nor a local CA")
+	}
+	privkey, pubkey, err := GenerateEphemeralKey()
+	if err != nil {
+		return SSHCredentials{}, err
+	}
+	signed, err := sign(ctx, pubkey)
+	if err != nil {
+		privkey.Destroy()
+		(*memguard.LockedBuffer)(pubkey).Destroy()
+		return SSHCredentials{}, err
+	}
+	return SSHCredentials{
+		PrivateKey:  privkey,
+		PublicKey:   pubkey,
+		Certificate: signed,
+		Signed:      true,
+	}, nil
+}
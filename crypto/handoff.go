@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/awnumar/memguard"
+)
+
+// WriteHandoff writes the JSON encoding of a handoff to a child process. The
+// secrets of the handoff are given as []byte, so that the encoding can be
+// wiped once it is written.
+func WriteHandoff(w io.Writer, handoff interface{}) error {
+	buf, err := json.Marshal(handoff)
+	if err != nil {
+		return err
+	}
+	defer memguard.WipeBytes(buf)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadHandoff reads a handoff written by WriteHandoff. The encoding is wiped
+// once it is decoded. The []byte secrets of the handoff should then be moved
+// to locked memory with memguard.NewImmutableFromBytes, that wipes them.
+func ReadHandoff(r io.Reader, handoff interface{}) error {
+	buf, err := readAllWiped(r)
+	if err != nil {
+		return err
+	}
+	defer memguard.WipeBytes(buf)
+	return json.Unmarshal(buf, handoff)
+}
+
+// readAllWiped reads r until EOF, like ioutil.ReadAll, but wipes the buffers
+// that are outgrown.
+func readAllWiped(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 0, 4096)
+	for {
+		if len(buf) == cap(buf) {
+			bigger := make([]byte, len(buf), 2*cap(buf))
+			copy(bigger, buf)
+			memguard.WipeBytes(buf)
+			buf = bigger
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			memguard.WipeBytes(buf)
+			return nil, err
+		}
+	}
+}
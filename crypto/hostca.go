@@ -0,0 +1,179 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/mitchellh/go-homedir"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// FetchHostCA returns the public key of the Vault SSH host signer mounted at mount.
+func FetchHostCA(ctx context.Context, clt *api.Client, mount string) ([]byte, error) {
+	r := clt.NewRequest("GET", fmt.Sprintf("/v1/%s/public_key", mount))
+	resp, err := clt.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("empty host CA public key")
+	}
+	if _, err := parseHostCAs(b); err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// RefreshHostCA fetches the host CA public key from Vault and writes it to the cache path.
+func RefreshHostCA(ctx context.Context, clt *api.Client, mount, path string, l *zap.SugaredLogger) error {
+	ca, err := FetchHostCA(ctx, clt, mount)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".hostca")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(ca)
+	_ = tmp.Close()
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	l.Debugw("host CA public key cached", "mount", mount, "path", path)
+	return nil
+}
+
+func parseHostCAs(b []byte) (keys []ssh.PublicKey, err error) {
+	for len(bytes.TrimSpace(b)) > 0 {
+		var key ssh.PublicKey
+		key, _, _, b, err = ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host CA public key: %s", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// defaultKnownHosts is the known_hosts file that is used when ssh_config
+// does not give UserKnownHostsFile.
+const defaultKnownHosts = "~/.ssh/known_hosts"
+
+// knownHostsCallback checks the host keys against the given known_hosts
+// files. The files that do not exist are skipped.
+func knownHostsCallback(files []string, l *zap.SugaredLogger) (ssh.HostKeyCallback, error) {
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		} else {
+			l.Debugw("known_hosts file not found", "path", f)
+		}
+	}
+	callback, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open known_hosts file: %s", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		l.Debugw(
+			"host key",
+			"hostname", hostname,
+			"remote", remote.String(),
+			"key", string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))),
+		)
+		return callback(hostname, remote, key)
+	}, nil
+}
+
+// MakeHostKeyCallback returns the callback that verifies the SSH server host key.
+//
+// When a host CA is configured, host certificates signed by that CA are
+// accepted if the host name is one of their principals. Plain host keys are
+// checked against the known_hosts file, or against the UserKnownHostsFile
+// files from ssh_config.
+func MakeHostKeyCallback(sshParams params.SSHParams, l *zap.SugaredLogger) (ssh.HostKeyCallback, error) {
+	if sshParams.Insecure {
+		return gssh.MakeHostKeyCallback(true, l)
+	}
+	files := sshParams.KnownHostsFiles
+	if files == nil {
+		kh, err := homedir.Expand(defaultKnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand known_hosts path: %s", err)
+		}
+		files = []string{kh}
+	}
+	// a missing known_hosts file is not an error: on a new machine, the host
+	// certificates may be the only way to check the host keys
+	fallback, err := knownHostsCallback(files, l)
+	if err != nil {
+		return nil, err
+	}
+	if sshParams.HostCA == "" {
+		return fallback, nil
+	}
+	b, err := ioutil.ReadFile(sshParams.HostCA)
+	if os.IsNotExist(err) {
+		l.Infow("host CA public key is not available", "path", sshParams.HostCA)
+		return fallback, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	authorities, err := parseHostCAs(b)
+	if err != nil {
+		return nil, err
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, authority := range authorities {
+				if bytes.Equal(auth.Marshal(), authority.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		HostKeyFallback: fallback,
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := checker.CheckHostKey(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return err
+		}
+		l.Debugw("host certificate was not accepted, checking the plain host key", "hostname", hostname, "error", err)
+		return fallback(hostname, remote, cert.Key)
+	}, nil
+}
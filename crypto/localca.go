@@ -0,0 +1,151 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stephane-martin/vssh/params"
+	"golang.org/x/crypto/ssh"
+)
+
+// localCADefaultTTL is the TTL of the certificates signed by a local CA, when
+// no TTL is requested.
+const localCADefaultTTL = 30 * time.Minute
+
+// localCABackdate makes the certificates valid a little before they are
+// signed, to tolerate clock skew between the client and the server.
+const localCABackdate = 30 * time.Second
+
+// localCADefaultExtensions are the extensions of the certificates signed by a
+// local CA, when no extension is requested. They are the ssh-keygen defaults.
+var localCADefaultExtensions = []string{
+	params.PermitX11Forwarding,
+	params.PermitAgentForwarding,
+	params.PermitPortForwarding,
+	params.PermitPTY,
+	params.PermitUserRC,
+}
+
+var localCAKeys = struct {
+	sync.Mutex
+	keys map[string]*memguard.LockedBuffer
+}{keys: make(map[string]*memguard.LockedBuffer)}
+
+// ReadLocalCA reads the private key of a local CA. The key is only read, and
+// its passphrase asked, once per process.
+func ReadLocalCA(path string) (*memguard.LockedBuffer, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	localCAKeys.Lock()
+	defer localCAKeys.Unlock()
+	if key, ok := localCAKeys.keys[path]; ok {
+		return key, nil
+	}
+	key, err := ReadPrivateKeyFromFileSystem(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the local CA key: %s", err)
+	}
+	localCAKeys.keys[path] = key
+	return key, nil
+}
+
+// LocalCertSigner returns a CertSigner that signs the user certificates in
+// process with the given CA private key, instead of asking Vault. The
+// certificates follow the same rules as the ones requested from Vault.
+func LocalCertSigner(caKey *memguard.LockedBuffer, sshParams params.SSHParams) (CertSigner, error) {
+	if _, err := ssh.ParsePrivateKey(caKey.Buffer()); err != nil {
+		return nil, fmt.Errorf("invalid local CA key: %s", err)
+	}
+	ttl := localCADefaultTTL
+	if sshParams.Sign.TTL != "" {
+		var err error
+		ttl, err = parseTTL(sshParams.Sign.TTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(ctx context.Context, pub *PublicKey) (*memguard.LockedBuffer, error) {
+		return SignLocally(caKey, pub, sshParams.LoginName, ttl, sshParams.Sign)
+	}, nil
+}
+
+// SignLocally signs a user certificate for pub with the CA private key, and
+// returns it in the authorized_keys format.
+func SignLocally(caKey *memguard.LockedBuffer, pub *PublicKey, login string, ttl time.Duration, signParams params.SignParams) (*memguard.LockedBuffer, error) {
+	ca, err := ssh.ParsePrivateKey(caKey.Buffer())
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParsePublicKey(append([]byte(nil), pub.Buffer()...))
+	if err != nil {
+		return nil, err
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	keyID := signParams.KeyID
+	if keyID == "" {
+		keyID = fmt.Sprintf("vssh-local-%s-%s", login, ssh.FingerprintSHA256(key))
+	}
+	extensions := signParams.Extensions
+	if len(extensions) == 0 {
+		extensions = localCADefaultExtensions
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: append([]string{login}, signParams.Principals...),
+		ValidAfter:      uint64(now.Add(-localCABackdate).Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: make(map[string]string, len(signParams.CriticalOptions)),
+			Extensions:      make(map[string]string, len(extensions)),
+		},
+	}
+	for k, v := range signParams.CriticalOptions {
+		cert.CriticalOptions[k] = v
+	}
+	for _, ext := range extensions {
+		cert.Extensions[ext] = ""
+	}
+	err = cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		return nil, err
+	}
+	b := ssh.MarshalAuthorizedKey(cert)
+	signed, err := memguard.NewImmutableFromBytes(b[:len(b)-1])
+	if err != nil {
+		memguard.WipeBytes(b)
+		return nil, err
+	}
+	return signed, nil
+}
+
+// parseTTL parses a TTL the way Vault does: a duration, or a number of
+// seconds.
+func parseTTL(ttl string) (time.Duration, error) {
+	var d time.Duration
+	if secs, err := strconv.ParseUint(ttl, 10, 32); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if d, err = time.ParseDuration(ttl); err != nil {
+		return 0, fmt.Errorf("invalid certificate TTL: %s", ttl)
+	}
+	if d <= 0 {
+		return 0, errors.New("the certificate TTL must be positive")
+	}
+	return d, nil
+}
@@ -0,0 +1,233 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/stephane-martin/vssh/params"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestKey generates an ed25519 key pair, with the private key in the
+// openssh-key-v1 format.
+func newTestKey(t *testing.T) (*memguard.LockedBuffer, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := marshalED25519PrivateKey(pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := memguard.NewImmutableFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, public
+}
+
+func newTestPublicKey(t *testing.T) *PublicKey {
+	t.Helper()
+	_, public := newTestKey(t)
+	buf, err := memguard.NewImmutableFromBytes(public.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return (*PublicKey)(buf)
+}
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		ttl     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{ttl: "300", want: 5 * time.Minute},
+		{ttl: "1h", want: time.Hour},
+		{ttl: "90s", want: 90 * time.Second},
+		{ttl: "0", wantErr: true},
+		{ttl: "0s", wantErr: true},
+		{ttl: "-5m", wantErr: true},
+		{ttl: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTTL(tt.ttl)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTTL(%q) error = %v, wantErr %v", tt.ttl, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTTL(%q) = %s, want %s", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestLocalCertSigner(t *testing.T) {
+	caKey, caPub := newTestKey(t)
+	tests := []struct {
+		name           string
+		sign           params.SignParams
+		wantTTL        time.Duration
+		wantKeyID      string
+		wantPrincipals []string
+		wantExtensions []string
+		wantOptions    map[string]string
+	}{
+		{
+			name:           "defaults",
+			wantTTL:        localCADefaultTTL,
+			wantPrincipals: []string{"alice"},
+			wantExtensions: localCADefaultExtensions,
+			wantOptions:    map[string]string{},
+		},
+		{
+			name: "requested options",
+			sign: params.SignParams{
+				TTL:             "1h",
+				KeyID:           "ci-run",
+				Principals:      []string{"deploy", "backup"},
+				Extensions:      []string{params.PermitPTY},
+				CriticalOptions: map[string]string{"force-command": "uptime", "source-address": "10.0.0.0/8"},
+			},
+			wantTTL:        time.Hour,
+			wantKeyID:      "ci-run",
+			wantPrincipals: []string{"alice", "deploy", "backup"},
+			wantExtensions: []string{params.PermitPTY},
+			wantOptions:    map[string]string{"force-command": "uptime", "source-address": "10.0.0.0/8"},
+		},
+		{
+			name:           "TTL in seconds",
+			sign:           params.SignParams{TTL: "120"},
+			wantTTL:        2 * time.Minute,
+			wantPrincipals: []string{"alice"},
+			wantExtensions: localCADefaultExtensions,
+			wantOptions:    map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sign, err := LocalCertSigner(caKey, params.SSHParams{LoginName: "alice", Sign: tt.sign})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub := newTestPublicKey(t)
+			signed, err := sign(context.Background(), pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, _, _, _, err := ssh.ParseAuthorizedKey(signed.Buffer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, ok := parsed.(*ssh.Certificate)
+			if !ok {
+				t.Fatalf("signed key is a %T, not a certificate", parsed)
+			}
+			if cert.CertType != ssh.UserCert {
+				t.Errorf("certificate type = %d, want a user certificate", cert.CertType)
+			}
+			if !reflect.DeepEqual(cert.Key.Marshal(), pub.Buffer()) {
+				t.Error("the certificate does not certify the public key")
+			}
+			if !reflect.DeepEqual(cert.SignatureKey.Marshal(), caPub.Marshal()) {
+				t.Error("the certificate is not signed by the local CA")
+			}
+			ttl := time.Duration(cert.ValidBefore-cert.ValidAfter)*time.Second - localCABackdate
+			if ttl < tt.wantTTL-2*time.Second || ttl > tt.wantTTL+2*time.Second {
+				t.Errorf("certificate TTL = %s, want %s", ttl, tt.wantTTL)
+			}
+			if tt.wantKeyID != "" && cert.KeyId != tt.wantKeyID {
+				t.Errorf("key ID = %q, want %q", cert.KeyId, tt.wantKeyID)
+			}
+			if !reflect.DeepEqual(cert.ValidPrincipals, tt.wantPrincipals) {
+				t.Errorf("principals = %v, want %v", cert.ValidPrincipals, tt.wantPrincipals)
+			}
+			var extensions []string
+			for ext := range cert.Extensions {
+				extensions = append(extensions, ext)
+			}
+			sort.Strings(extensions)
+			wantExtensions := append([]string(nil), tt.wantExtensions...)
+			sort.Strings(wantExtensions)
+			if !reflect.DeepEqual(extensions, wantExtensions) {
+				t.Errorf("extensions = %v, want %v", extensions, wantExtensions)
+			}
+			if !reflect.DeepEqual(cert.CriticalOptions, tt.wantOptions) {
+				t.Errorf("critical options = %v, want %v", cert.CriticalOptions, tt.wantOptions)
+			}
+			checker := ssh.CertChecker{
+				SupportedCriticalOptions: []string{"force-command", "source-address"},
+				IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return reflect.DeepEqual(auth.Marshal(), caPub.Marshal())
+				},
+			}
+			if err := checker.CheckCert("alice", cert); err != nil {
+				t.Errorf("the certificate is not valid for alice: %s", err)
+			}
+		})
+	}
+}
+
+func TestLocalCertSignerRejects(t *testing.T) {
+	caKey, _ := newTestKey(t)
+	for _, ttl := range []string{"0", "0s", "-1h", "tomorrow"} {
+		_, err := LocalCertSigner(caKey, params.SSHParams{LoginName: "alice", Sign: params.SignParams{TTL: ttl}})
+		if err == nil {
+			t.Errorf("TTL %q was accepted", ttl)
+		}
+	}
+	notAKey, err := memguard.NewImmutableFromBytes([]byte("not a private key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LocalCertSigner(notAKey, params.SSHParams{LoginName: "alice"})
+	if err == nil {
+		t.Error("an invalid CA key was accepted")
+	}
+}
+
+func TestReadLocalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vssh-localca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	caKey, _ := newTestKey(t)
+	path := filepath.Join(dir, "ca")
+	err = ioutil.WriteFile(path, caKey.Buffer(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadLocalCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ssh.ParsePrivateKey(key.Buffer()); err != nil {
+		t.Fatalf("the local CA key does not parse: %s", err)
+	}
+	again, err := ReadLocalCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != key {
+		t.Error("the local CA key was read twice")
+	}
+	_, err = ReadLocalCA(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Error("a missing local CA key was accepted")
+	}
+}
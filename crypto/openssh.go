@@ -0,0 +1,302 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/awnumar/memguard"
+	"github.com/dchest/bcrypt_pbkdf"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const opensshMagic = "openssh-key-v1\x00"
+
+// opensshKey is the outer structure of a private key in the openssh-key-v1
+// format, as written by ssh-keygen since OpenSSH 7.8.
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+type opensshKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+	// Rest holds the authentication tag of the AEAD ciphers.
+	Rest []byte `ssh:"rest"`
+}
+
+type opensshCipher struct {
+	keyLen int
+	ivLen  int
+	mode   string
+}
+
+var opensshCiphers = map[string]opensshCipher{
+	"aes128-ctr":             {keyLen: 16, ivLen: aes.BlockSize, mode: "ctr"},
+	"aes192-ctr":             {keyLen: 24, ivLen: aes.BlockSize, mode: "ctr"},
+	"aes256-ctr":             {keyLen: 32, ivLen: aes.BlockSize, mode: "ctr"},
+	"aes128-cbc":             {keyLen: 16, ivLen: aes.BlockSize, mode: "cbc"},
+	"aes192-cbc":             {keyLen: 24, ivLen: aes.BlockSize, mode: "cbc"},
+	"aes256-cbc":             {keyLen: 32, ivLen: aes.BlockSize, mode: "cbc"},
+	"aes128-gcm@openssh.com": {keyLen: 16, ivLen: 12, mode: "gcm"},
+	"aes256-gcm@openssh.com": {keyLen: 32, ivLen: 12, mode: "gcm"},
+}
+
+func parseOpenSSHKey(der []byte) (*opensshKey, error) {
+	if len(der) < len(opensshMagic) || string(der[:len(opensshMagic)]) != opensshMagic {
+		return nil, errors.New("invalid openssh private key format")
+	}
+	k := new(opensshKey)
+	err := ssh.Unmarshal(der[len(opensshMagic):], k)
+	if err != nil {
+		return nil, err
+	}
+	if k.NumKeys != 1 {
+		return nil, fmt.Errorf("unsupported number of keys in the openssh private key: %d", k.NumKeys)
+	}
+	return k, nil
+}
+
+func (k *opensshKey) encrypted() bool {
+	return k.CipherName != "none"
+}
+
+// decrypt returns the private part of the key, decrypted with the key derived
+// from the passphrase by bcrypt_pbkdf.
+func (k *opensshKey) decrypt(pass []byte) ([]byte, error) {
+	if k.KdfName != "bcrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function: %s", k.KdfName)
+	}
+	c, ok := opensshCiphers[k.CipherName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key cipher: %s", k.CipherName)
+	}
+	var opts struct {
+		Salt   []byte
+		Rounds uint32
+	}
+	err := ssh.Unmarshal([]byte(k.KdfOpts), &opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.PrivKeyBlock)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted private key length")
+	}
+	derived, err := bcrypt_pbkdf.Key(pass, opts.Salt, int(opts.Rounds), c.keyLen+c.ivLen)
+	if err != nil {
+		return nil, err
+	}
+	defer memguard.WipeBytes(derived)
+	block, err := aes.NewCipher(derived[:c.keyLen])
+	if err != nil {
+		return nil, err
+	}
+	iv := derived[c.keyLen:]
+	decrypted := make([]byte, len(k.PrivKeyBlock))
+	switch c.mode {
+	case "cbc":
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, k.PrivKeyBlock)
+	case "ctr":
+		cipher.NewCTR(block, iv).XORKeyStream(decrypted, k.PrivKeyBlock)
+	case "gcm":
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(k.Rest) < aead.Overhead() {
+			return nil, errors.New("missing authentication tag in the encrypted private key")
+		}
+		sealed := append(append([]byte{}, k.PrivKeyBlock...), k.Rest[:aead.Overhead()]...)
+		_, err = aead.Open(decrypted[:0], iv, sealed, nil)
+		if err != nil {
+			return nil, errors.New("wrong passphrase")
+		}
+	}
+	return decrypted, nil
+}
+
+// decryptOpenSSHKey decrypts a private key in the openssh-key-v1 format, and
+// encodes it again in a PEM format that the ssh package can parse.
+func decryptOpenSSHKey(der, pass []byte) ([]byte, error) {
+	k, err := parseOpenSSHKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if !k.encrypted() {
+		return opensshKeyToPEM(k.PrivKeyBlock)
+	}
+	decrypted, err := k.decrypt(pass)
+	if err != nil {
+		return nil, err
+	}
+	defer memguard.WipeBytes(decrypted)
+	return opensshKeyToPEM(decrypted)
+}
+
+// opensshKeyToPEM converts the private part of an openssh-key-v1 key. RSA and
+// ECDSA keys are converted to the legacy PEM formats, and ed25519 keys to an
+// unencrypted openssh-key-v1 key.
+func opensshKeyToPEM(block []byte) ([]byte, error) {
+	// the check integers differ when the passphrase is wrong
+	var check struct {
+		Check1 uint32
+		Check2 uint32
+		Rest   []byte `ssh:"rest"`
+	}
+	err := ssh.Unmarshal(block, &check)
+	if err != nil {
+		return nil, err
+	}
+	if check.Check1 != check.Check2 {
+		return nil, errors.New("wrong passphrase")
+	}
+	var pk1 struct {
+		Keytype string
+		Rest    []byte `ssh:"rest"`
+	}
+	err = ssh.Unmarshal(check.Rest, &pk1)
+	if err != nil {
+		return nil, err
+	}
+	switch pk1.Keytype {
+	case ssh.KeyAlgoRSA:
+		var key struct {
+			N       *big.Int
+			E       *big.Int
+			D       *big.Int
+			Iqmp    *big.Int
+			P       *big.Int
+			Q       *big.Int
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		err := ssh.Unmarshal(pk1.Rest, &key)
+		if err != nil {
+			return nil, err
+		}
+		pk := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: key.N, E: int(key.E.Int64())},
+			D:         key.D,
+			Primes:    []*big.Int{key.P, key.Q},
+		}
+		err = pk.Validate()
+		if err != nil {
+			return nil, err
+		}
+		pk.Precompute()
+		der := x509.MarshalPKCS1PrivateKey(pk)
+		defer memguard.WipeBytes(der)
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), nil
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var key struct {
+			Curve   string
+			Pub     []byte
+			D       *big.Int
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		err := ssh.Unmarshal(pk1.Rest, &key)
+		if err != nil {
+			return nil, err
+		}
+		var curve elliptic.Curve
+		switch key.Curve {
+		case "nistp256":
+			curve = elliptic.P256()
+		case "nistp384":
+			curve = elliptic.P384()
+		case "nistp521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve: %s", key.Curve)
+		}
+		x, y := elliptic.Unmarshal(curve, key.Pub)
+		if x == nil {
+			return nil, errors.New("invalid ECDSA public key")
+		}
+		pk := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         key.D,
+		}
+		der, err := x509.MarshalECPrivateKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		defer memguard.WipeBytes(der)
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case ssh.KeyAlgoED25519:
+		var key struct {
+			Pub     []byte
+			Priv    []byte
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		err := ssh.Unmarshal(pk1.Rest, &key)
+		if err != nil {
+			return nil, err
+		}
+		if len(key.Pub) != ed25519.PublicKeySize || len(key.Priv) != ed25519.PrivateKeySize {
+			return nil, errors.New("invalid ed25519 private key")
+		}
+		return marshalED25519PrivateKey(key.Pub, key.Priv)
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %s", pk1.Keytype)
+	}
+}
+
+// marshalED25519PrivateKey encodes an ed25519 private key in the unencrypted
+// openssh-key-v1 PEM format.
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+func marshalED25519PrivateKey(pub ed25519.PublicKey, priv ed25519.PrivateKey) ([]byte, error) {
+	public, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var check [4]byte
+	_, err = rand.Read(check[:])
+	if err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check[:])
+	pk1 := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{
+		Check1:  checkInt,
+		Check2:  checkInt,
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     pub,
+		Priv:    priv,
+	}
+	block := ssh.Marshal(pk1)
+	for i := 1; len(block)%8 != 0; i++ {
+		block = append(block, byte(i))
+	}
+	w := opensshKey{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       public.Marshal(),
+		PrivKeyBlock: block,
+	}
+	der := append([]byte(opensshMagic), ssh.Marshal(w)...)
+	memguard.WipeBytes(block)
+	res := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: der})
+	memguard.WipeBytes(der)
+	return res, nil
+}
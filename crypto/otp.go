@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/awnumar/memguard"
+	"github.com/hashicorp/vault/api"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+)
+
+// OTPCredentials asks the Vault SSH OTP secrets engine for a one-time password
+// to log in to the SSH server. The password is sent through both the password
+// and the keyboard-interactive auth methods, as the server may only accept one
+// of them.
+func OTPCredentials(ctx context.Context, clt *api.Client, vaultParams params.VaultParams, sshParams params.SSHParams, l *zap.SugaredLogger) ([]SSHCredentials, error) {
+	if clt == nil {
+		return nil, errors.New("one-time passwords are delivered by Vault, but there is no Vault client")
+	}
+	ip, err := resolveIP(ctx, sshParams.Host)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{
+		"ip":       ip,
+		"username": sshParams.LoginName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := clt.NewRequest("PUT", fmt.Sprintf("/v1/%s/creds/%s", vaultParams.OTPMount, vaultParams.OTPRole))
+	r.BodyBytes = body
+	resp, err := clt.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil && resp == nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := memguard.NewImmutableFromBytes(b)
+	if err != nil {
+		memguard.WipeBytes(b)
+		return nil, err
+	}
+	defer respBody.Destroy()
+	p := new(fastjson.Parser)
+	val, err := p.ParseBytes(respBody.Buffer())
+	if err != nil {
+		return nil, err
+	}
+	key := val.GetStringBytes("data", "key")
+	if len(key) == 0 {
+		errStr := string(val.GetStringBytes("errors", "0"))
+		if errStr != "" {
+			return nil, errors.New(errStr)
+		}
+		return nil, errors.New("unexpected Vault response")
+	}
+	if keyType := string(val.GetStringBytes("data", "key_type")); keyType != "" && keyType != "otp" {
+		return nil, fmt.Errorf("the Vault role %s does not deliver one-time passwords but %s", vaultParams.OTPRole, keyType)
+	}
+	otp, err := memguard.NewImmutableFromBytes(key)
+	if err != nil {
+		memguard.WipeBytes(key)
+		return nil, err
+	}
+	l.Debugw("one-time password delivered by vault", "ip", ip, "role", vaultParams.OTPRole)
+	return []SSHCredentials{
+		{Password: otp},
+		{Password: otp, Interactive: true},
+	}, nil
+}
+
+// resolveIP returns the IP address of the SSH server, as Vault checks OTP
+// requests against the CIDR list of the role.
+func resolveIP(ctx context.Context, host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String(), nil
+		}
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no IP address for %s", host)
+	}
+	return addrs[0].IP.String(), nil
+}
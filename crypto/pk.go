@@ -28,16 +28,42 @@ func NeedPassphrase(privkey *memguard.LockedBuffer) (bool, error) {
 	if block == nil {
 		return false, errors.New("failed to PEM-decode the private key")
 	}
-	memguard.WipeBytes(block.Bytes)
+	defer memguard.WipeBytes(block.Bytes)
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		k, err := parseOpenSSHKey(block.Bytes)
+		if err != nil {
+			return false, err
+		}
+		return k.encrypted(), nil
+	}
 	return strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"), nil
 }
 
 // DecryptPrivateKey returns the decrypted version of the given private key, using a passphrase.
+// Keys in the openssh-key-v1 format are converted to a format that the ssh
+// package understands, even when they are not encrypted.
 func DecryptPrivateKey(privkey, pass *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
 	block, _ := pem.Decode(privkey.Buffer())
 	if block == nil {
 		return nil, errors.New("failed to PEM-decode the private key")
 	}
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		var passBytes []byte
+		if pass != nil {
+			passBytes = pass.Buffer()
+		}
+		decryptedBuf, err := decryptOpenSSHKey(block.Bytes, passBytes)
+		memguard.WipeBytes(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		decrypted, err := memguard.NewImmutableFromBytes(decryptedBuf)
+		if err != nil {
+			memguard.WipeBytes(decryptedBuf)
+			return nil, err
+		}
+		return decrypted, nil
+	}
 	if x509.IsEncryptedPEMBlock(block) {
 		typ := block.Type
 		der, err := x509.DecryptPEMBlock(block, pass.Buffer())
@@ -166,19 +192,22 @@ func ReadPrivateKeyFromFileSystem(path string) (*memguard.LockedBuffer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing private key: %s", err)
 	}
+	var pass *memguard.LockedBuffer
 	if needPass {
-		pass, err := InputPassword("Enter the passphrase for the private key")
+		pass, err = InputPassword("Enter the passphrase for " + path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get passphrase: %s", err)
 		}
-		decrypted, err := DecryptPrivateKey(privkey, pass)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt private key: %s", err)
-		}
+		defer pass.Destroy()
+	}
+	decrypted, err := DecryptPrivateKey(privkey, pass)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %s", err)
+	}
+	if decrypted != privkey {
 		privkey.Destroy()
-		privkey = decrypted
 	}
-	return privkey, nil
+	return decrypted, nil
 }
 
 func InputPassword(prompt string) (*memguard.LockedBuffer, error) {
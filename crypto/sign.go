@@ -1,33 +1,46 @@
 package crypto
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"runtime"
+	"strings"
 
+	"github.com/stephane-martin/vssh/params"
 	"go.uber.org/zap"
 
 	"github.com/awnumar/memguard"
-	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/vault/api"
-	"github.com/hashicorp/vault/helper/consts"
 	"github.com/valyala/fastjson"
 )
 
-func Sign(ctx context.Context, pub *PublicKey, login, sshMount, sshRole string, clt *api.Client, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
+func Sign(ctx context.Context, pub *PublicKey, login, sshMount, sshRole string, signParams params.SignParams, clt *api.Client, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
 	defer runtime.GC()
+	principals := append([]string{login}, signParams.Principals...)
 	data := map[string]interface{}{
-		"valid_principals": login,
+		"valid_principals": strings.Join(principals, ","),
 		"public_key":       pub,
 		"cert_type":        "user",
 	}
+	if signParams.TTL != "" {
+		data["ttl"] = signParams.TTL
+	}
+	if signParams.KeyID != "" {
+		data["key_id"] = signParams.KeyID
+	}
+	if len(signParams.Extensions) > 0 {
+		extensions := make(map[string]string, len(signParams.Extensions))
+		for _, ext := range signParams.Extensions {
+			extensions[ext] = ""
+		}
+		data["extensions"] = extensions
+	}
+	if len(signParams.CriticalOptions) > 0 {
+		data["critical_options"] = signParams.CriticalOptions
+	}
 	buf, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
@@ -38,28 +51,18 @@ func Sign(ctx context.Context, pub *PublicKey, login, sshMount, sshRole string,
 		return nil, err
 	}
 	defer reqBody.Destroy()
-	u, err := url.Parse(clt.Address())
-	if err != nil {
-		return nil, err
+	// the request goes through the vault client so that it uses the same TLS,
+	// namespace and timeout configuration as the other vault calls
+	r := clt.NewRequest("PUT", fmt.Sprintf("/v1/%s/sign/%s", sshMount, sshRole))
+	r.BodyBytes = reqBody.Buffer()
+	resp, err := clt.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
 	}
-	u.Path = fmt.Sprintf("/v1/%s/sign/%s", sshMount, sshRole)
-	r := &http.Request{
-		Method:        "PUT",
-		URL:           u,
-		Body:          ioutil.NopCloser(bytes.NewReader(reqBody.Buffer())),
-		GetBody:       func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(reqBody.Buffer())), nil },
-		ContentLength: int64(len(reqBody.Buffer())),
-		Close:         true,
-		Host:          u.Host,
-		Header:        make(http.Header),
-	}
-	r.Header.Set(consts.AuthHeaderName, clt.Token())
-	resp, err := cleanhttp.DefaultClient().Do(r.WithContext(ctx))
-	if err != nil {
+	if err != nil && resp == nil {
 		return nil, err
 	}
 	b, err := ioutil.ReadAll(resp.Body)
-	_ = resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
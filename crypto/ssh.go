@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"os"
+	"time"
 
 	"github.com/awnumar/memguard"
 	"github.com/hashicorp/vault/api"
@@ -22,7 +23,15 @@ type SSHCredentials struct {
 	PublicKey   *PublicKey
 	Certificate *memguard.LockedBuffer
 	Password    *memguard.LockedBuffer
+	// Interactive sends the password with keyboard-interactive auth.
+	Interactive bool
 	Agent       bool
+	// Signed means that the certificate was signed by Vault or by the local
+	// CA for this connection, instead of being read from the filesystem.
+	Signed bool
+	// ControlMaster means that the connection goes through the control
+	// master, which needs no authentication.
+	ControlMaster bool
 }
 
 func (c SSHCredentials) AuthMethod() (ssh.AuthMethod, error) {
@@ -48,6 +57,16 @@ func (c SSHCredentials) AuthMethod() (ssh.AuthMethod, error) {
 		}
 		return ssh.PublicKeys(s), nil
 	}
+	if c.Password != nil && c.Interactive {
+		password := string(c.Password.Buffer())
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range questions {
+				answers[i] = password
+			}
+			return answers, nil
+		}), nil
+	}
 	if c.Password != nil {
 		return ssh.Password(string(c.Password.Buffer())), nil
 	}
@@ -58,23 +77,105 @@ func (c SSHCredentials) AuthMethod() (ssh.AuthMethod, error) {
 		}
 		return agent, nil
 	}
+	if c.ControlMaster {
+		// never used, as the control master accepts the "none" method
+		return ssh.Password(""), nil
+	}
 	return nil, errors.New("no credentials")
 }
 
-func GetAgentAuth() (ssh.AuthMethod, error) {
+func dialAgent() (agent.ExtendedAgent, net.Conn, error) {
 	sock := os.Getenv("SSH_AUTH_SOCK")
 	if len(sock) == 0 {
-		return nil, errors.New("SSH_AUTH_SOCK is not set")
+		return nil, nil, errors.New("SSH_AUTH_SOCK is not set")
 	}
 	agconn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return agent.NewClient(agconn), agconn, nil
+}
+
+func GetAgentAuth() (ssh.AuthMethod, error) {
+	ag, _, err := dialAgent()
 	if err != nil {
 		return nil, err
 	}
-	ag := agent.NewClient(agconn)
 	auth := ssh.PublicKeysCallback(ag.Signers)
 	return auth, nil
 }
 
+// AddToAgent adds the private key and its certificate to the agent at
+// SSH_AUTH_SOCK. The agent forgets them when the certificate expires.
+func AddToAgent(credential SSHCredentials, confirm bool) (*ssh.Certificate, error) {
+	if credential.PrivateKey == nil || credential.Certificate == nil {
+		return nil, errors.New("no certificate to add to the agent")
+	}
+	key, err := addedKey(credential)
+	if err != nil {
+		return nil, err
+	}
+	key.ConfirmBeforeUse = confirm
+	ag, conn, err := dialAgent()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	err = ag.Add(key)
+	if err != nil {
+		return nil, err
+	}
+	return key.Certificate, nil
+}
+
+// NewKeyring returns an agent, in memory, that holds the private keys of the
+// credentials with their certificates.
+func NewKeyring(credentials []SSHCredentials) (agent.Agent, error) {
+	keyring := agent.NewKeyring()
+	for _, credential := range credentials {
+		if credential.PrivateKey == nil {
+			continue
+		}
+		key, err := addedKey(credential)
+		if err != nil {
+			return nil, err
+		}
+		err = keyring.Add(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keyring, nil
+}
+
+// addedKey returns the private key and the certificate, if any, of the
+// credential in the form of the agent. The key expires with the certificate.
+func addedKey(credential SSHCredentials) (agent.AddedKey, error) {
+	var key agent.AddedKey
+	if credential.Certificate != nil {
+		cert, err := gssh.ParseCertificate(credential.Certificate.Buffer())
+		if err != nil {
+			return key, err
+		}
+		if cert.ValidBefore != ssh.CertTimeInfinity {
+			remaining := int64(cert.ValidBefore) - time.Now().Unix()
+			if remaining <= 0 {
+				return key, errors.New("the certificate has expired")
+			}
+			key.LifetimeSecs = uint32(remaining)
+		}
+		key.Certificate = cert
+		key.Comment = "vault certificate " + cert.KeyId
+	}
+	// TODO: the private key content leaks in p. wipe it.
+	p, err := ssh.ParseRawPrivateKey(credential.PrivateKey.Buffer())
+	if err != nil {
+		return key, err
+	}
+	key.PrivateKey = p
+	return key, nil
+}
+
 func CredentialsToMethods(credentials []SSHCredentials, logger *zap.SugaredLogger) (methods []ssh.AuthMethod) {
 	for _, credential := range credentials {
 		m, err := credential.AuthMethod()
@@ -87,13 +188,53 @@ func CredentialsToMethods(credentials []SSHCredentials, logger *zap.SugaredLogge
 	return methods
 }
 
-func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName string, useAgent bool, l *zap.SugaredLogger) (*api.Client, []SSHCredentials, error) {
+// GetSSHCredentials returns the credentials to connect to the SSH server. With
+// a control path, the connection goes through the control master, which is
+// started with the credentials if it does not run yet.
+func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, sshParams params.SSHParams, l *zap.SugaredLogger) (*api.Client, []SSHCredentials, error) {
+	if credentials, ok := handedOffCredentials(sshParams); ok {
+		return nil, credentials, nil
+	}
+	vaultClient, credentials, err := getSSHCredentials(ctx, clictx, sshParams, l)
+	if err != nil || sshParams.ControlPath == "" || len(credentials) == 0 || credentials[0].ControlMaster {
+		return vaultClient, credentials, err
+	}
+	err = StartControlMaster(ctx, clictx, sshParams, credentials, l)
+	if err != nil {
+		l.Warnw("failed to start the control master", "error", err)
+		return vaultClient, credentials, nil
+	}
+	l.Infow("enabled: connection of the control master", "path", sshParams.ControlPath)
+	return vaultClient, []SSHCredentials{{ControlMaster: true}}, nil
+}
+
+func getSSHCredentials(ctx context.Context, clictx params.CLIContext, sshParams params.SSHParams, l *zap.SugaredLogger) (*api.Client, []SSHCredentials, error) {
+	// the control master is already authenticated: there is no need to log in
+	// to Vault, and the caller logs in if it needs Vault for something else,
+	// like the secrets
+	if sshParams.ControlPath != "" && ControlMasterRunning(sshParams.ControlPath) {
+		l.Infow("enabled: connection of the control master", "path", sshParams.ControlPath)
+		return nil, []SSHCredentials{{ControlMaster: true}}, nil
+	}
+
+	// the agent has the certificates signed: there is no need to log in to
+	// Vault either, and the cached host CA is still used
+	if sshParams.UseAgent {
+		l.Infow("enabled: auth by SSH agent")
+		return nil, []SSHCredentials{{Agent: true}}, nil
+	}
+
 	var credentials []SSHCredentials
 	var vaultClient *api.Client
 
 	vaultParams := vault.GetVaultParams(clictx)
-	if vaultParams.SSHMount != "" {
-		if vaultParams.SSHRole != "" {
+	// the local CA signs without Vault, that may well be unreachable: Vault is
+	// then only needed for a private key or a one-time password it keeps
+	localCA := clictx.LocalCA()
+	if localCA != "" && clictx.VPrivateKey() == "" && vaultParams.OTPRole == "" {
+		l.Debugw("signing with the local CA, not logging in to Vault", "path", localCA)
+	} else if vaultParams.SSHMount != "" || vaultParams.OTPMount != "" {
+		if vaultParams.SSHRole != "" || vaultParams.OTPRole != "" {
 			client, err := vault.GetVaultClient(ctx, vaultParams, l)
 			if err == nil {
 				vaultClient = client
@@ -110,47 +251,49 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 		l.Infow("vault SSH mount point is not set")
 	}
 
-	if useAgent {
-		l.Infow("enabled: auth by SSH agent")
-		return vaultClient, []SSHCredentials{{Agent: true}}, nil
+	if vaultClient != nil && vaultParams.SSHHostMount != "" && sshParams.HostCA != "" {
+		err := RefreshHostCA(ctx, vaultClient, vaultParams.SSHHostMount, sshParams.HostCA, l)
+		if err == context.Canceled {
+			return nil, nil, err
+		} else if err != nil {
+			l.Warnw("failed to fetch the host CA public key from vault", "error", err)
+		}
 	}
 
-	privateKeyPath := clictx.PrivateKey()
-	if privateKeyPath == "" {
-		privateKeyPath = "~/.ssh/id_rsa"
-	}
-	p, err := homedir.Expand(privateKeyPath)
-	if err != nil {
-		return nil, nil, err
+	var sign CertSigner
+	signer := "vault"
+	if localCA != "" {
+		caKey, err := ReadLocalCA(localCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		sign, err = LocalCertSigner(caKey, sshParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer = "local CA"
+	} else if vaultClient != nil && vaultParams.SSHRole != "" {
+		sign = func(ctx context.Context, pub *PublicKey) (*memguard.LockedBuffer, error) {
+			return Sign(ctx, pub, sshParams.LoginName, vaultParams.SSHMount, vaultParams.SSHRole, sshParams.Sign, vaultClient, l)
+		}
 	}
-	privateKeyPath = p
 
-	var pubkeyFS *PublicKey
-	privkeyFS, err := ReadPrivateKeyFromFileSystem(privateKeyPath)
-	if err != nil {
-		l.Infow("failed to read private key from filesystem", "path", privateKeyPath, "error", err)
-	} else {
-		pubkey, err := DerivePublicKey(privkeyFS)
+	if clictx.Ephemeral() {
+		credential, err := EphemeralCredentials(ctx, sign)
 		if err != nil {
-			l.Warnw("failed to derive public key from filesystem private key", "error", err)
-		} else {
-			pubkeyFS = pubkey
+			return nil, nil, err
 		}
+		l.Infow("enabled: ephemeral private key, signed by " + signer)
+		return vaultClient, []SSHCredentials{credential}, nil
 	}
-	var certificateFS *memguard.LockedBuffer
-	if pubkeyFS != nil {
-		certificatePath := privateKeyPath + "-cert.pub"
-		_, err := os.Stat(certificatePath)
-		if err == nil {
-			cert, err := ReadCertificateFromFileSystem(certificatePath)
-			if err == nil {
-				certificateFS = cert
-			} else {
-				l.Warnw("failed to read certificate from filesystem", "error", err)
-			}
-		} else {
-			l.Infow("matching certificate not found for filesystem private key", "error", err)
-		}
+
+	paths := clictx.PrivateKeys()
+	if len(paths) == 0 {
+		paths = sshParams.IdentityFiles
+	}
+	fsKeys, err := readFSKeys(paths, l)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	privateKeyVaultPath := clictx.VPrivateKey()
@@ -176,8 +319,8 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 	}
 
 	var certificatePKVault *memguard.LockedBuffer
-	if pubkeyVault != nil && vaultClient != nil {
-		signed, err := Sign(ctx, pubkeyVault, loginName, vaultParams.SSHMount, vaultParams.SSHRole, vaultClient, l)
+	if pubkeyVault != nil && sign != nil {
+		signed, err := sign(ctx, pubkeyVault)
 		if err == nil {
 			certificatePKVault = signed
 		} else if err == context.Canceled {
@@ -186,15 +329,16 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 			l.Warnw("failed to sign vault private key", "error", err)
 		}
 	}
-	var certificatePKFS *memguard.LockedBuffer
-	if certificatePKVault == nil && pubkeyFS != nil && vaultClient != nil {
-		signed, err := Sign(ctx, pubkeyFS, loginName, vaultParams.SSHMount, vaultParams.SSHRole, vaultClient, l)
-		if err == nil {
-			certificatePKFS = signed
-		} else if err == context.Canceled {
-			return nil, nil, err
-		} else {
-			l.Warnw("failed to sign filesystem private key", "error", err)
+	if certificatePKVault == nil && sign != nil {
+		for i, key := range fsKeys {
+			signed, err := sign(ctx, key.pubkey)
+			if err == nil {
+				fsKeys[i].signed = signed
+			} else if err == context.Canceled {
+				return nil, nil, err
+			} else {
+				l.Warnw("failed to sign filesystem private key", "path", key.path, "error", err)
+			}
 		}
 	}
 
@@ -203,16 +347,20 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 			PrivateKey:  privkeyVault,
 			PublicKey:   pubkeyVault,
 			Certificate: certificatePKVault,
+			Signed:      true,
 		})
-		l.Infow("enabled: private key from vault, signed by vault")
+		l.Infow("enabled: private key from vault, signed by " + signer)
 	}
-	if certificatePKFS != nil {
-		credentials = append(credentials, SSHCredentials{
-			PrivateKey:  privkeyFS,
-			PublicKey:   pubkeyFS,
-			Certificate: certificatePKFS,
-		})
-		l.Infow("enabled: private key from filesystem, signed by vault")
+	for _, key := range fsKeys {
+		if key.signed != nil {
+			credentials = append(credentials, SSHCredentials{
+				PrivateKey:  key.privkey,
+				PublicKey:   key.pubkey,
+				Certificate: key.signed,
+				Signed:      true,
+			})
+			l.Infow("enabled: private key from filesystem, signed by "+signer, "path", key.path)
+		}
 	}
 	if pubkeyVault != nil {
 		credentials = append(credentials, SSHCredentials{
@@ -221,21 +369,31 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 		})
 		l.Infow("enabled: private key from vault, no certificate")
 	}
-	if pubkeyFS != nil {
-		if certificateFS != nil {
+	for _, key := range fsKeys {
+		if key.certificate != nil {
 			credentials = append(credentials, SSHCredentials{
-				PrivateKey:  privkeyFS,
-				PublicKey:   pubkeyFS,
-				Certificate: certificateFS,
+				PrivateKey:  key.privkey,
+				PublicKey:   key.pubkey,
+				Certificate: key.certificate,
 			})
-			l.Infow("enabled: private key and certificate from filesystem")
+			l.Infow("enabled: private key and certificate from filesystem", "path", key.path)
 		}
-
 		credentials = append(credentials, SSHCredentials{
-			PrivateKey: privkeyFS,
-			PublicKey:  pubkeyFS,
+			PrivateKey: key.privkey,
+			PublicKey:  key.pubkey,
 		})
-		l.Infow("enabled: private key from filesystem, no certificate")
+		l.Infow("enabled: private key from filesystem, no certificate", "path", key.path)
+	}
+	if vaultParams.OTPRole != "" {
+		otps, err := OTPCredentials(ctx, vaultClient, vaultParams, sshParams, l)
+		if err == nil {
+			credentials = append(credentials, otps...)
+			l.Infow("enabled: one-time password from vault")
+		} else if err == context.Canceled {
+			return nil, nil, err
+		} else {
+			l.Warnw("failed to get a one-time password from vault", "error", err)
+		}
 	}
 	if clictx.SSHPassword() {
 		pass, err := InputPassword("Enter SSH password")
@@ -249,3 +407,63 @@ func GetSSHCredentials(ctx context.Context, clictx params.CLIContext, loginName
 	}
 	return vaultClient, credentials, nil
 }
+
+// defaultPrivateKeys are the private keys that are tried, in order, when no
+// identity is given.
+var defaultPrivateKeys = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+type fsKey struct {
+	path        string
+	privkey     *memguard.LockedBuffer
+	pubkey      *PublicKey
+	certificate *memguard.LockedBuffer
+	signed      *memguard.LockedBuffer
+}
+
+// readFSKeys reads the private keys from the filesystem, with the matching
+// certificates if they exist. When no path is given, the default keys that
+// exist are read.
+func readFSKeys(paths []string, l *zap.SugaredLogger) ([]fsKey, error) {
+	discover := len(paths) == 0
+	if discover {
+		paths = defaultPrivateKeys
+	}
+	var keys []fsKey
+	for _, path := range paths {
+		p, err := homedir.Expand(path)
+		if err != nil {
+			return nil, err
+		}
+		if discover {
+			if _, err := os.Stat(p); err != nil {
+				l.Debugw("default private key not found", "path", p)
+				continue
+			}
+		}
+		privkey, err := ReadPrivateKeyFromFileSystem(p)
+		if err != nil {
+			l.Infow("failed to read private key from filesystem", "path", p, "error", err)
+			continue
+		}
+		pubkey, err := DerivePublicKey(privkey)
+		if err != nil {
+			l.Warnw("failed to derive public key from filesystem private key", "path", p, "error", err)
+			continue
+		}
+		key := fsKey{path: p, privkey: privkey, pubkey: pubkey}
+		certificatePath := p + "-cert.pub"
+		_, err = os.Stat(certificatePath)
+		if err == nil {
+			cert, err := ReadCertificateFromFileSystem(certificatePath)
+			if err == nil {
+				key.certificate = cert
+			} else {
+				l.Warnw("failed to read certificate from filesystem", "path", certificatePath, "error", err)
+			}
+		} else {
+			l.Infow("matching certificate not found for filesystem private key", "error", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
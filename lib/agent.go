@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ListenAgent listens on the unix socket of the agent. The socket is only
+// accessible by the current user.
+func ListenAgent(socketPath string) (net.Listener, error) {
+	return listenUnix(socketPath, "an agent")
+}
+
+// listenUnix listens on a unix socket that is only accessible by the current
+// user. what names the server, in the error when one already listens.
+func listenUnix(socketPath, what string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(socketPath), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// a socket left by a server that was killed would prevent to listen
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s is already listening on %s", what, socketPath)
+	}
+	_ = os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ServeAgent serves the ssh-agent protocol on the listener, until the context
+// is canceled.
+func ServeAgent(ctx context.Context, listener net.Listener, ag agent.Agent, l *zap.SugaredLogger) error {
+	defer func() { _ = listener.Close() }()
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	l.Infow("agent listening", "socket", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			err := agent.ServeAgent(ag, conn)
+			if err != nil && err != io.EOF {
+				l.Debugw("agent connection closed", "error", err)
+			}
+		}()
+	}
+}
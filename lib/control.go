@@ -0,0 +1,364 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	controlCheckRequest = "check@vssh"
+	controlExitRequest  = "exit@vssh"
+)
+
+// controlGrace is how long a new control master waits for its first
+// connection.
+const controlGrace = 30 * time.Second
+
+// controlMaster shares its SSH connection with the vssh commands that connect
+// to its unix socket. Each command speaks SSH on the socket, without
+// authentication, and the control master opens the channels of the command on
+// its own connection.
+type controlMaster struct {
+	client  *ssh.Client
+	config  *ssh.ServerConfig
+	persist time.Duration
+	logger  *zap.SugaredLogger
+
+	sync.Mutex
+	conns    int
+	idle     *time.Timer
+	forwards map[string]*ssh.ServerConn
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// ServeControl serves the control master on the unix socket, until it is
+// asked to exit, the connection to the SSH server closes, or it stays idle for
+// longer than persist (forever when persist is negative). The ready file, if
+// any, is closed when the control master listens.
+func ServeControl(ctx context.Context, client *ssh.Client, socketPath string, persist time.Duration, ready *os.File, l *zap.SugaredLogger) error {
+	defer func() { _ = client.Close() }()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	// the socket is only accessible by the current user
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	listener, err := listenUnix(socketPath, "a control master")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(socketPath) }()
+	defer func() { _ = listener.Close() }()
+
+	m := &controlMaster{
+		client:   client,
+		config:   config,
+		persist:  persist,
+		logger:   l,
+		forwards: make(map[string]*ssh.ServerConn),
+		done:     make(chan struct{}),
+	}
+	grace := persist
+	if grace < controlGrace {
+		grace = controlGrace
+	}
+	m.idle = time.AfterFunc(grace, m.stop)
+	if persist < 0 {
+		m.idle.Stop()
+	}
+	go m.forwardedConnections(client.HandleChannelOpen("forwarded-tcpip"))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+
+	if ready != nil {
+		_, _ = ready.WriteString("ok")
+		_ = ready.Close()
+	}
+	l.Infow("control master listening", "socket", socketPath)
+	select {
+	case <-m.done:
+		l.Infow("control master exiting")
+	case <-closed:
+		l.Infow("the connection to the SSH server closed")
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func (m *controlMaster) stop() {
+	m.stopOnce.Do(func() { close(m.done) })
+}
+
+func (m *controlMaster) connected() {
+	m.Lock()
+	m.conns++
+	m.idle.Stop()
+	m.Unlock()
+}
+
+func (m *controlMaster) disconnected(conn *ssh.ServerConn) {
+	m.Lock()
+	defer m.Unlock()
+	for addr, c := range m.forwards {
+		if c == conn {
+			delete(m.forwards, addr)
+		}
+	}
+	m.conns--
+	if m.conns == 0 && m.persist >= 0 {
+		m.idle.Reset(m.persist)
+	}
+}
+
+func (m *controlMaster) serve(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, m.config)
+	if err != nil {
+		m.logger.Debugw("control connection failed", "error", err)
+		_ = conn.Close()
+		return
+	}
+	m.connected()
+	defer m.disconnected(sconn)
+	go m.globalRequests(sconn, reqs)
+	for newChannel := range chans {
+		go m.forwardChannel(newChannel)
+	}
+}
+
+func (m *controlMaster) globalRequests(sconn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case controlCheckRequest:
+			_ = req.Reply(true, ssh.Marshal(struct{ Pid uint32 }{uint32(os.Getpid())}))
+		case controlExitRequest:
+			_ = req.Reply(true, nil)
+			m.stop()
+		case "tcpip-forward", "cancel-tcpip-forward":
+			ok, payload, err := m.client.SendRequest(req.Type, true, req.Payload)
+			if err != nil {
+				ok = false
+			}
+			if ok {
+				m.registerForward(sconn, req.Type == "tcpip-forward", req.Payload, payload)
+			}
+			_ = req.Reply(ok, payload)
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// registerForward records which control connection asked for a remote
+// forwarding, to give it the connections of that forwarding.
+func (m *controlMaster) registerForward(sconn *ssh.ServerConn, add bool, request, reply []byte) {
+	var fwd struct {
+		Addr string
+		Port uint32
+	}
+	if ssh.Unmarshal(request, &fwd) != nil {
+		return
+	}
+	if add && fwd.Port == 0 {
+		// the server chose the port
+		var bound struct{ Port uint32 }
+		if ssh.Unmarshal(reply, &bound) != nil {
+			return
+		}
+		fwd.Port = bound.Port
+	}
+	addr := net.JoinHostPort(fwd.Addr, strconv.Itoa(int(fwd.Port)))
+	m.Lock()
+	if add {
+		m.forwards[addr] = sconn
+	} else {
+		delete(m.forwards, addr)
+	}
+	m.Unlock()
+}
+
+// forwardedConnections gives the connections of the remote forwardings to the
+// control connections that asked for them.
+func (m *controlMaster) forwardedConnections(chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		var fwd struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}
+		if ssh.Unmarshal(newChannel.ExtraData(), &fwd) != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, "invalid forwarded-tcpip payload")
+			continue
+		}
+		m.Lock()
+		sconn := m.forwards[net.JoinHostPort(fwd.Addr, strconv.Itoa(int(fwd.Port)))]
+		m.Unlock()
+		if sconn == nil {
+			_ = newChannel.Reject(ssh.Prohibited, "no forwarding for this address")
+			continue
+		}
+		go func(newChannel ssh.NewChannel) {
+			down, downReqs, err := sconn.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+			if err != nil {
+				rejectChannel(newChannel, err)
+				return
+			}
+			up, upReqs, err := newChannel.Accept()
+			if err != nil {
+				_ = down.Close()
+				return
+			}
+			pipeChannels(down, downReqs, up, upReqs)
+		}(newChannel)
+	}
+}
+
+// forwardChannel opens the channel of a control connection on the SSH server.
+func (m *controlMaster) forwardChannel(newChannel ssh.NewChannel) {
+	up, upReqs, err := m.client.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		rejectChannel(newChannel, err)
+		return
+	}
+	down, downReqs, err := newChannel.Accept()
+	if err != nil {
+		_ = up.Close()
+		return
+	}
+	pipeChannels(down, downReqs, up, upReqs)
+}
+
+func rejectChannel(newChannel ssh.NewChannel, err error) {
+	if openErr, ok := err.(*ssh.OpenChannelError); ok {
+		_ = newChannel.Reject(openErr.Reason, openErr.Message)
+		return
+	}
+	_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+}
+
+// pipeChannels copies the data and the requests between the channel of a
+// control connection and the channel of the SSH server, until both are closed.
+func pipeChannels(down ssh.Channel, downReqs <-chan *ssh.Request, up ssh.Channel, upReqs <-chan *ssh.Request) {
+	var toDown sync.WaitGroup
+	toDown.Add(2)
+	go func() {
+		_, _ = io.Copy(down, up)
+		toDown.Done()
+	}()
+	go func() {
+		_, _ = io.Copy(down.Stderr(), up.Stderr())
+		toDown.Done()
+	}()
+	go func() {
+		toDown.Wait()
+		_ = down.CloseWrite()
+	}()
+	go func() {
+		_, _ = io.Copy(up, down)
+		_ = up.CloseWrite()
+	}()
+	go func() {
+		forwardRequests(up, downReqs)
+		_ = up.Close()
+	}()
+	forwardRequests(down, upReqs)
+	// the exit status is sent before the channel closes
+	toDown.Wait()
+	_ = down.Close()
+}
+
+func forwardRequests(to ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok, err := to.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			_ = req.Reply(ok && err == nil, nil)
+		}
+	}
+}
+
+// controlConnect connects to the control master. The connection is used like
+// a connection to the SSH server.
+func controlConnect(socketPath string) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, socketPath, &ssh.ClientConfig{
+		User: "vssh",
+		// the socket is only accessible by the current user
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// ControlCheck returns the pid of the control master that listens on the
+// socket.
+func ControlCheck(socketPath string) (int, error) {
+	client, err := controlConnect(socketPath)
+	if err != nil {
+		return 0, fmt.Errorf("no control master on %s", socketPath)
+	}
+	defer func() { _ = client.Close() }()
+	ok, reply, err := client.SendRequest(controlCheckRequest, true, nil)
+	if err != nil {
+		return 0, err
+	}
+	var pid struct{ Pid uint32 }
+	if !ok || ssh.Unmarshal(reply, &pid) != nil {
+		return 0, errors.New("invalid answer of the control master")
+	}
+	return int(pid.Pid), nil
+}
+
+// ControlExit asks the control master that listens on the socket to exit.
+func ControlExit(socketPath string) error {
+	client, err := controlConnect(socketPath)
+	if err != nil {
+		return fmt.Errorf("no control master on %s", socketPath)
+	}
+	defer func() { _ = client.Close() }()
+	ok, _, err := client.SendRequest(controlExitRequest, true, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("the control master refused to exit")
+	}
+	return nil
+}
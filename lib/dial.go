@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Dial connects to the SSH server, through the control master, the jump hosts
+// or the proxy given in sshParams. When a ServerAliveInterval is set, the client sends keepalive requests, and
+// closes the connection when the server stops answering them.
+func Dial(ctx context.Context, cfg gssh.Config, sshParams params.SSHParams, l *zap.SugaredLogger) (*ssh.Client, error) {
+	if sshParams.ControlPath != "" {
+		client, err := controlConnect(sshParams.ControlPath)
+		if err == nil {
+			l.Debugw("connected through the control master", "socket", sshParams.ControlPath)
+			return client, nil
+		}
+		l.Debugw("failed to connect to the control master", "socket", sshParams.ControlPath, "error", err)
+	}
+	var client *ssh.Client
+	var err error
+	if len(sshParams.Jumps) == 0 {
+		client, err = dialWith(ctx, transportDialer(cfg, sshParams, l), cfg)
+	} else {
+		client, err = dialJumps(ctx, cfg, sshParams.Jumps, l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sshParams.ServerAliveInterval > 0 {
+		go keepAlive(client, sshParams.ServerAliveInterval, sshParams.ServerAliveCountMax, l)
+	}
+	return client, nil
+}
+
+// dialJumps connects to each jump host through the previous one, with its
+// own credentials, and then to the destination through the last one. Only the
+// first jump host is reached through the proxy.
+func dialJumps(ctx context.Context, cfg gssh.Config, jumps []params.Jump, l *zap.SugaredLogger) (*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			_ = hops[i].Close()
+		}
+	}
+	var via *ssh.Client
+	for _, jump := range jumps {
+		hopCfg, err := jumpConfig(ctx, jump, l)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %s", jump.SSH.Host, err)
+		}
+		dial := transportDialer(hopCfg, jump.SSH, l)
+		if via != nil {
+			dial = viaDialer(via)
+		}
+		hop, err := dialWith(ctx, dial, hopCfg)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %s", jump.SSH.Host, err)
+		}
+		l.Debugw("connected to jump host", "host", jump.SSH.Host, "port", jump.SSH.Port)
+		hops = append(hops, hop)
+		via = hop
+	}
+	client, err := dialWith(ctx, viaDialer(via), cfg)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+	// the jump hosts connections are closed with the destination connection
+	go func() {
+		_ = client.Wait()
+		closeHops()
+	}()
+	return client, nil
+}
+
+// jumpConfig gets the credentials for a jump host, signed with the options
+// of that jump host.
+func jumpConfig(ctx context.Context, jump params.Jump, l *zap.SugaredLogger) (gssh.Config, error) {
+	_, credentials, err := crypto.GetSSHCredentials(ctx, jump.Context, jump.SSH, l)
+	if err != nil {
+		return gssh.Config{}, err
+	}
+	methods := crypto.CredentialsToMethods(credentials, l)
+	if len(methods) == 0 {
+		return gssh.Config{}, errors.New("no usable credentials")
+	}
+	hkcb, err := crypto.MakeHostKeyCallback(jump.SSH, l)
+	if err != nil {
+		return gssh.Config{}, err
+	}
+	return gssh.Config{
+		User:      jump.SSH.LoginName,
+		Host:      jump.SSH.Host,
+		Port:      jump.SSH.Port,
+		Auth:      methods,
+		HTTPProxy: jump.SSH.HTTPProxy,
+		HostKey:   hkcb,
+	}, nil
+}
+
+// viaDialer returns a dialFunc that opens the connections through the via SSH
+// connection.
+func viaDialer(via *ssh.Client) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return via.Dial(network, addr)
+	}
+}
+
+// dialWith connects to the SSH server with the dial function. Like gssh.Dial,
+// each auth method is tried on its own connection.
+func dialWith(ctx context.Context, dial dialFunc, cfg gssh.Config) (*ssh.Client, error) {
+	addr := cfg.GetAddr()
+	err := errors.New("no auth method")
+	for _, native := range cfg.ToNatives() {
+		var conn net.Conn
+		conn, err = dial(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		var c ssh.Conn
+		var chans <-chan ssh.NewChannel
+		var reqs <-chan *ssh.Request
+		c, chans, reqs, err = ssh.NewClientConn(conn, addr, native)
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+		client := ssh.NewClient(c, chans, reqs)
+		if ctx.Err() != nil {
+			_ = client.Close()
+			return nil, ctx.Err()
+		}
+		return client, nil
+	}
+	return nil, err
+}
+
+// sftpClient opens a SFTP session on a new connection.
+func sftpClient(ctx context.Context, cfg gssh.Config, sshParams params.SSHParams, l *zap.SugaredLogger) (*sftp.Client, error) {
+	conn, err := Dial(ctx, cfg, sshParams, l)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// remoteCommand is a command that runs on the SSH server, on its own
+// connection.
+type remoteCommand struct {
+	conn    *ssh.Client
+	session *ssh.Session
+	stop    context.CancelFunc
+	Stdin   io.WriteCloser
+	Stdout  io.Reader
+	Stderr  io.Reader
+}
+
+// startCommand starts command on a new connection. The command is stopped
+// when the context is canceled.
+func startCommand(ctx context.Context, cfg gssh.Config, sshParams params.SSHParams, command string, l *zap.SugaredLogger) (*remoteCommand, error) {
+	conn, err := Dial(ctx, cfg, sshParams, l)
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	cmd := &remoteCommand{conn: conn, session: session}
+	cmd.Stdin, err = session.StdinPipe()
+	if err == nil {
+		cmd.Stdout, err = session.StdoutPipe()
+	}
+	if err == nil {
+		cmd.Stderr, err = session.StderrPipe()
+	}
+	if err == nil {
+		err = session.Start(command)
+	}
+	if err != nil {
+		_ = session.Close()
+		_ = conn.Close()
+		return nil, err
+	}
+	lctx, cancel := context.WithCancel(ctx)
+	cmd.stop = cancel
+	go func() {
+		<-lctx.Done()
+		_ = session.Close()
+	}()
+	return cmd, nil
+}
+
+// Wait waits for the command to exit, and closes the connection.
+func (cmd *remoteCommand) Wait() error {
+	err := cmd.session.Wait()
+	cmd.stop()
+	_ = cmd.conn.Close()
+	return err
+}
+
+// keepAlive sends a keepalive request every interval, like the OpenSSH
+// ServerAliveInterval option. The connection is closed when countMax requests
+// in a row are left unanswered.
+func keepAlive(client *ssh.Client, interval time.Duration, countMax int, l *zap.SugaredLogger) {
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var unanswered int32
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if int(atomic.LoadInt32(&unanswered)) >= countMax {
+			l.Warnw("the SSH server does not answer keepalives, closing the connection", "unanswered", countMax)
+			_ = client.Close()
+			return
+		}
+		atomic.AddInt32(&unanswered, 1)
+		go func() {
+			// any reply, even a failure, shows that the server is alive
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			if err == nil {
+				atomic.StoreInt32(&unanswered, 0)
+			}
+		}()
+	}
+}
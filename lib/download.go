@@ -14,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/stephane-martin/vssh/crypto"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/remoteops"
 	"github.com/stephane-martin/vssh/sys"
@@ -36,12 +37,12 @@ func SFTPClient(gparams params.SSHParams, methods []ssh.AuthMethod, l *zap.Sugar
 		Auth:      methods,
 		HTTPProxy: gparams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
+	hkcb, err := crypto.MakeHostKeyCallback(gparams, l)
 	if err != nil {
 		return nil, err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(context.Background(), cfg)
+	client, err := sftpClient(context.Background(), cfg, gparams, l)
 	if err != nil {
 		return nil, err
 	}
@@ -59,12 +60,12 @@ func SFTPListAuth(ctx context.Context, gparams params.SSHParams, auth []ssh.Auth
 		Auth:      auth,
 		HTTPProxy: gparams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
+	hkcb, err := crypto.MakeHostKeyCallback(gparams, l)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(ctx, cfg)
+	client, err := sftpClient(ctx, cfg, gparams, l)
 	if err != nil {
 		return err
 	}
@@ -100,12 +101,12 @@ func SFTPGetAuth(ctx context.Context, srcs []string, gparams params.SSHParams, a
 		Auth:      auth,
 		HTTPProxy: gparams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
+	hkcb, err := crypto.MakeHostKeyCallback(gparams, l)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(ctx, cfg)
+	client, err := sftpClient(ctx, cfg, gparams, l)
 	if err != nil {
 		return err
 	}
@@ -196,14 +197,14 @@ func ScpGetAuth(ctx context.Context, srcs []string, gparams params.SSHParams, au
 		Auth:      auth,
 		HTTPProxy: gparams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
+	hkcb, err := crypto.MakeHostKeyCallback(gparams, l)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
 
 	for _, source := range srcs {
-		err := receive(ctx, cfg, source, cb, l)
+		err := receive(ctx, cfg, gparams, source, cb, l)
 		if err != nil {
 			return err
 		}
@@ -251,7 +252,7 @@ func SFTPList(ctx context.Context, gparams params.SSHParams, privkey, cert *memg
 	return SFTPListAuth(ctx, gparams, []ssh.AuthMethod{a}, l, cb)
 }
 
-func receive(ctx context.Context, cfg gssh.Config, src string, cb Callback, l *zap.SugaredLogger) error {
+func receive(ctx context.Context, cfg gssh.Config, gparams params.SSHParams, src string, cb Callback, l *zap.SugaredLogger) error {
 	lctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var p string
@@ -263,7 +264,7 @@ func receive(ctx context.Context, cfg gssh.Config, src string, cb Callback, l *z
 	opts := "-q -f -r -p"
 	command := fmt.Sprintf("scp %s %s", opts, p)
 	l.Debugw("remote command", "cmd", command)
-	clt, err := gssh.StartCommand(lctx, cfg, command)
+	clt, err := startCommand(lctx, cfg, gparams, command, l)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/awnumar/memguard"
+	"github.com/stephane-martin/vssh/crypto"
+)
+
+// ExportCredentials writes the private key, the public key and the certificate
+// to path, path.pub and path-cert.pub, the names that ssh expects. Each file
+// ends with a newline, like the files of ssh-keygen. Existing files are only
+// overwritten when force is set.
+func ExportCredentials(path string, priv *memguard.LockedBuffer, pub *crypto.PublicKey, cert *memguard.LockedBuffer, force bool) ([]string, error) {
+	serialized, err := crypto.SerializePublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	defer serialized.Destroy()
+	files := []struct {
+		path string
+		key  *memguard.LockedBuffer
+	}{
+		{path, priv},
+		{path + ".pub", serialized},
+		{path + "-cert.pub", cert},
+	}
+	if !force {
+		for _, f := range files {
+			if _, err := os.Lstat(f.path); err == nil {
+				return nil, fmt.Errorf("%s already exists", f.path)
+			}
+		}
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		err := writeKey(f.path, f.key)
+		if err != nil {
+			return paths, fmt.Errorf("failed to write %s: %s", f.path, err)
+		}
+		paths = append(paths, f.path)
+	}
+	return paths, nil
+}
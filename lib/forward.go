@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/go-socks5"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/hidden"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+// ListenForward listens for the connections of a port forwarding: locally
+// for the local and dynamic forwardings, and on the SSH server for the
+// remote ones.
+func ListenForward(client *ssh.Client, fwd params.Forward) (net.Listener, error) {
+	switch {
+	case fwd.Type == params.RemoteForward:
+		return client.Listen(fwd.ListenNetwork, fwd.ListenAddr)
+	case fwd.ListenNetwork == "unix":
+		return listenUnix(fwd.ListenAddr, "a forwarding")
+	default:
+		return net.Listen(fwd.ListenNetwork, fwd.ListenAddr)
+	}
+}
+
+// startForwards listens for all the port forwardings, and then forwards their
+// connections in the background, until ctx is canceled.
+func startForwards(ctx context.Context, client *ssh.Client, forwards []params.Forward, l *zap.SugaredLogger) error {
+	listeners := make([]net.Listener, 0, len(forwards))
+	for _, fwd := range forwards {
+		listener, err := ListenForward(client, fwd)
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			return fmt.Errorf("%s forwarding %s failed: %s", fwd.Type, fwd.Spec, err)
+		}
+		if strings.HasSuffix(fwd.ListenAddr, ":0") {
+			l.Infow("allocated port", "forwarding", fwd.Spec, "address", listener.Addr().String())
+		}
+		listeners = append(listeners, listener)
+	}
+	for i, fwd := range forwards {
+		go func(fwd params.Forward, listener net.Listener) {
+			err := ServeForward(ctx, client, fwd, listener, l)
+			if err != nil {
+				l.Warnw("forwarding stopped", "forwarding", fwd.Spec, "error", err)
+			}
+		}(fwd, listeners[i])
+	}
+	return nil
+}
+
+// ServeForward forwards the connections accepted on the listener through the
+// SSH connection, until ctx is canceled. The listener is closed when it
+// returns.
+func ServeForward(ctx context.Context, client *ssh.Client, fwd params.Forward, listener net.Listener, l *zap.SugaredLogger) error {
+	if fwd.Type == params.DynamicForward {
+		return ServeSOCKS(ctx, client, listener, serverResolver{}, l)
+	}
+	g, lctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		<-lctx.Done()
+		return listener.Close()
+	})
+
+	g.Go(func() error {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return err
+			}
+			l.Debugw("accepted a new connection", "forwarding", fwd.Spec)
+			g.Go(func() error {
+				var target net.Conn
+				var err error
+				if fwd.Type == params.RemoteForward {
+					target, err = net.Dial(fwd.ConnectNetwork, fwd.ConnectAddr)
+				} else {
+					target, err = client.Dial(fwd.ConnectNetwork, fwd.ConnectAddr)
+				}
+				if err != nil {
+					l.Warnw("failed to connect to the forwarding target", "target", fwd.ConnectAddr, "error", err)
+					_ = conn.Close()
+					return nil
+				}
+				joinConns(lctx, conn, target)
+				l.Debugw("closed connection", "forwarding", fwd.Spec)
+				return nil
+			})
+		}
+	})
+
+	err := g.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// joinConns copies the data between the two connections, until both sides
+// have closed, or ctx is canceled.
+func joinConns(ctx context.Context, a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = a.Close()
+		_ = b.Close()
+	}()
+	defer close(done)
+	go func() {
+		_, _ = io.Copy(a, b)
+		_ = a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+}
+
+// serverResolver lets the SSH server resolve the host names, like ssh -D.
+type serverResolver struct{}
+
+func (serverResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// socksLogOnce sends the logs of the SOCKS servers to the logger, once for
+// all the servers.
+var socksLogOnce sync.Once
+
+// ServeSOCKS serves a SOCKS5 server on the listener, that opens the
+// connections through the SSH connection, until ctx is canceled. The host
+// names are resolved with resolver.
+func ServeSOCKS(ctx context.Context, client *ssh.Client, listener net.Listener, resolver socks5.NameResolver, l *zap.SugaredLogger) error {
+	socksConfig := socks5.Config{
+		Resolver: resolver,
+		Dial: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return client.Dial(network, addr)
+		},
+	}
+	socksLogOnce.Do(func() {
+		golog.SetOutputs(ioutil.Discard, ioutil.Discard)
+		golog.RegisterReporter(func(err error, linePrefix string, severity golog.Severity, ctx map[string]interface{}) {
+			kv := make([]interface{}, 0, 2*len(ctx)+2)
+			kv = append(kv, "error", hidden.Clean(err.Error()))
+			for k, v := range ctx {
+				kv = append(kv, k, v)
+			}
+			l.Debugw("socks error", kv...)
+		})
+	})
+
+	socksServer, err := socks5.New(&socksConfig)
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	err = socksServer.Serve(listener)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
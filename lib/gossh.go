@@ -3,12 +3,9 @@ package lib
 import (
 	"context"
 	"errors"
-	"fmt"
-	"os"
-	"strings"
 
+	"github.com/stephane-martin/vssh/crypto"
 	"github.com/stephane-martin/vssh/params"
-	"github.com/stephane-martin/vssh/sys"
 
 	"github.com/awnumar/memguard"
 	gssh "github.com/stephane-martin/golang-ssh"
@@ -16,7 +13,7 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func GoConnectAuth(ctx context.Context, sshParams params.SSHParams, terminal bool, auth []ssh.AuthMethod, env map[string]string, l *zap.SugaredLogger) error {
+func GoConnectAuth(ctx context.Context, sshParams params.SSHParams, terminal bool, auth []ssh.AuthMethod, secrets params.Secrets, l *zap.SugaredLogger) error {
 	if len(auth) == 0 {
 		return errors.New("no auth method")
 	}
@@ -27,32 +24,20 @@ func GoConnectAuth(ctx context.Context, sshParams params.SSHParams, terminal boo
 		Auth:      auth,
 		HTTPProxy: sshParams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(sshParams.Insecure, l)
+	hkcb, err := crypto.MakeHostKeyCallback(sshParams, l)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
 
-	var pre []string
-	if len(env) != 0 {
-		pre = append(pre, "env")
-		pre = append(pre, sys.EscapeEnv(env)...)
-		if len(sshParams.Commands) == 0 {
-			pre = append(pre, "bash")
-		}
-	}
-	commands := append(pre, sshParams.Commands...)
-	if len(sshParams.Commands) == 0 || terminal {
-		return gssh.Shell(ctx, cfg, os.Stdin, os.Stdout, os.Stderr, commands...)
-	}
-	err = gssh.OutputWithPty(ctx, cfg, strings.Join(commands, " "), os.Stdout, os.Stderr)
+	err = params.CheckSecretMode(secrets.Mode)
 	if err != nil {
-		return fmt.Errorf("failed to execute command: %s", err)
+		return err
 	}
-	return nil
+	return goConnectSession(ctx, cfg, sshParams, terminal, secrets, l)
 }
 
-func GoConnect(ctx context.Context, sshParams params.SSHParams, terminal bool, privkey, cert *memguard.LockedBuffer, env map[string]string, l *zap.SugaredLogger) error {
+func GoConnect(ctx context.Context, sshParams params.SSHParams, terminal bool, privkey, cert *memguard.LockedBuffer, secrets params.Secrets, l *zap.SugaredLogger) error {
 	c, err := gssh.ParseCertificate(cert.Buffer())
 	if err != nil {
 		return err
@@ -65,5 +50,5 @@ func GoConnect(ctx context.Context, sshParams params.SSHParams, terminal bool, p
 	if err != nil {
 		return err
 	}
-	return GoConnectAuth(ctx, sshParams, terminal, []ssh.AuthMethod{ssh.PublicKeys(signer)}, env, l)
+	return GoConnectAuth(ctx, sshParams, terminal, []ssh.AuthMethod{ssh.PublicKeys(signer)}, secrets, l)
 }
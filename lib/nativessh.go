@@ -3,41 +3,130 @@ package lib
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"github.com/stephane-martin/vssh/crypto"
-	"github.com/stephane-martin/vssh/params"
-	"github.com/stephane-martin/vssh/sys"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/awnumar/memguard"
+	"github.com/stephane-martin/vssh/crypto"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
 	"go.uber.org/zap"
 )
 
-func writePubkey(dir string, pub *crypto.PublicKey) (string, error) {
-	pubkeyPath := filepath.Join(dir, "key.pub")
-	serialized, err := crypto.SerializePublicKey(pub)
+// nativeEnv lets the native OpenSSH tools connect like the builtin client. It
+// is a private temporary directory that holds a ssh_config generated from the
+// resolved SSH parameters, the public keys and the certificates, and the
+// socket of an agent that holds the private keys while the tool runs.
+type nativeEnv struct {
+	dir    string
+	config string
+	// host is the name of the destination in the generated ssh_config.
+	host   string
+	cancel context.CancelFunc
+}
+
+func newNativeEnv(ctx context.Context, sshParams params.SSHParams, credentials []crypto.SSHCredentials, l *zap.SugaredLogger) (n *nativeEnv, err error) {
+	first := sshParams
+	if len(sshParams.Jumps) > 0 {
+		first = sshParams.Jumps[0].SSH
+	}
+	if first.Proxy != nil || first.HTTPProxy != nil {
+		return nil, errors.New("the native ssh client only supports the proxy command, not the SOCKS5 or HTTP proxies")
+	}
+	dir, err := ioutil.TempDir("", "vssh")
 	if err != nil {
-		return pubkeyPath, err
+		return nil, fmt.Errorf("failed to create temporary directory: %s", err)
 	}
-	return pubkeyPath, writeKey(pubkeyPath, serialized)
+	l.Debugw("using temp directory", "dirname", dir)
+	lctx, cancel := context.WithCancel(ctx)
+	n = &nativeEnv{dir: dir, config: filepath.Join(dir, "config"), cancel: cancel}
+	defer func() {
+		if err != nil {
+			n.Close()
+		}
+	}()
+
+	// the jump hosts get their own credentials, in the same agent
+	all := credentials
+	for _, jump := range sshParams.Jumps {
+		_, jumpCredentials, err := crypto.GetSSHCredentials(ctx, jump.Context, jump.SSH, l)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %s", jump.SSH.Host, err)
+		}
+		all = append(all, jumpCredentials...)
+	}
+	var identities []string
+	var agentSocket string
+	if !sshParams.UseAgent {
+		for i, credential := range all {
+			if credential.PrivateKey == nil || credential.PublicKey == nil {
+				continue
+			}
+			identity, err := writeIdentity(dir, i, credential)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, identity)
+		}
+	}
+	if len(identities) > 0 {
+		keyring, err := crypto.NewKeyring(all)
+		if err != nil {
+			return nil, err
+		}
+		agentSocket = filepath.Join(dir, "agent.sock")
+		listener, err := listenUnix(agentSocket, "an agent")
+		if err != nil {
+			return nil, err
+		}
+		go func() { _ = ServeAgent(lctx, listener, keyring, l) }()
+	}
+	err = n.writeConfig(sshParams, identities, agentSocket)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
 }
 
-func writePrivkey(dir string, priv *memguard.LockedBuffer) (string, error) {
-	privkeyPath := filepath.Join(dir, "key")
-	return privkeyPath, writeKey(privkeyPath, priv)
+// Close stops the agent and removes the temporary directory.
+func (n *nativeEnv) Close() {
+	n.cancel()
+	_ = os.RemoveAll(n.dir)
 }
 
-func writeCert(dir string, cert *memguard.LockedBuffer) (string, error) {
-	certPath := filepath.Join(dir, "key-cert.pub")
-	return certPath, writeKey(certPath, cert)
+// writeIdentity writes the certificate of a credential, or its public key when
+// there is no certificate, for the IdentityFile option. The private key stays
+// in the agent.
+func writeIdentity(dir string, i int, credential crypto.SSHCredentials) (string, error) {
+	if credential.Certificate != nil {
+		certPath := filepath.Join(dir, fmt.Sprintf("id-%d-cert.pub", i))
+		return certPath, writeKey(certPath, credential.Certificate)
+	}
+	pubkeyPath := filepath.Join(dir, fmt.Sprintf("id-%d.pub", i))
+	pub, err := crypto.SerializePublicKey(credential.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	defer pub.Destroy()
+	return pubkeyPath, writeKey(pubkeyPath, pub)
 }
 
+// writeKey writes key to a new file, that only the user can read. An existing
+// file is removed first, so that its mode, or the target of a symlink, is not
+// kept.
 func writeKey(path string, key *memguard.LockedBuffer) error {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return err
 	}
@@ -50,72 +139,323 @@ func writeKey(path string, key *memguard.LockedBuffer) error {
 	return err
 }
 
-func NativeConnect(ctx context.Context, sshParams params.SSHParams, terminal, verbose bool, priv *memguard.LockedBuffer, pub *crypto.PublicKey, cert *memguard.LockedBuffer, env map[string]string, l *zap.SugaredLogger) error {
-	dir, err := ioutil.TempDir("", "vssh")
-	if err != nil {
-		return fmt.Errorf("failed to create temporary directory: %s", err)
+// writeConfig generates the ssh_config of the destination and of the jump
+// hosts. The ssh_config files that vssh has read are included at the end, so
+// that the native client still gets the options that vssh does not resolve.
+func (n *nativeEnv) writeConfig(sshParams params.SSHParams, identities []string, agentSocket string) error {
+	var b bytes.Buffer
+	names := make(map[string]bool)
+	hostCAFiles := make(map[string]string)
+	n.host = nativeHostName(sshParams, "vssh-destination", names)
+	jumpNames := make([]string, 0, len(sshParams.Jumps))
+	for i, jump := range sshParams.Jumps {
+		jumpNames = append(jumpNames, nativeHostName(jump.SSH, fmt.Sprintf("vssh-jump-%d", i+1), names))
 	}
-	l.Debugw("using temp directory", "dirname", dir)
-	defer func() { _ = os.RemoveAll(dir) }()
 
-	pubkeyPath, err := writePubkey(dir, pub)
-	defer func() { _ = os.Remove(pubkeyPath) }()
+	var proxyJump string
+	proxyCommand := sshParams.ProxyCommand
+	if len(jumpNames) > 0 {
+		proxyJump = strings.Join(jumpNames, ",")
+		proxyCommand = ""
+	}
+	err := n.writeHostConfig(&b, n.host, sshParams, proxyJump, proxyCommand, hostCAFiles)
 	if err != nil {
 		return err
 	}
-	privkeyPath, err := writePrivkey(dir, priv)
-	defer func() { _ = os.Remove(privkeyPath) }()
+	for i, jump := range sshParams.Jumps {
+		// only the first jump host is reached through the proxy command
+		proxyCommand := ""
+		if i == 0 {
+			proxyCommand = jump.SSH.ProxyCommand
+		}
+		err := n.writeHostConfig(&b, jumpNames[i], jump.SSH, "", proxyCommand, hostCAFiles)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.WriteString("Host *\n")
+	b.WriteString("\tForwardAgent no\n")
+	b.WriteString("\tAddKeysToAgent no\n")
+	// the control master of vssh does not speak the OpenSSH protocol
+	b.WriteString("\tControlMaster no\n")
+	b.WriteString("\tControlPath none\n")
+	if agentSocket != "" {
+		fmt.Fprintf(&b, "\tIdentityAgent %s\n", configQuote(agentSocket))
+		b.WriteString("\tIdentitiesOnly yes\n")
+		for _, identity := range identities {
+			fmt.Fprintf(&b, "\tIdentityFile %s\n", configQuote(identity))
+		}
+	}
+	if len(sshParams.SSHConfigFiles) > 0 {
+		b.WriteString("Match all\n")
+		for _, f := range sshParams.SSHConfigFiles {
+			if !strings.HasPrefix(f, "~") {
+				abs, err := filepath.Abs(f)
+				if err != nil {
+					return err
+				}
+				f = abs
+			}
+			fmt.Fprintf(&b, "\tInclude %s\n", configQuote(f))
+		}
+	}
+	return ioutil.WriteFile(n.config, b.Bytes(), 0600)
+}
+
+// writeHostConfig writes the options of a host, as resolved by vssh. As the
+// first obtained value of an option is used, they win over the included
+// ssh_config files.
+func (n *nativeEnv) writeHostConfig(w io.Writer, name string, p params.SSHParams, proxyJump, proxyCommand string, hostCAFiles map[string]string) error {
+	fmt.Fprintf(w, "Host %s\n", name)
+	fmt.Fprintf(w, "\tHostName %s\n", p.Host)
+	fmt.Fprintf(w, "\tUser %s\n", configQuote(p.LoginName))
+	fmt.Fprintf(w, "\tPort %d\n", p.Port)
+	switch {
+	case proxyJump != "":
+		fmt.Fprintf(w, "\tProxyJump %s\n", proxyJump)
+	case proxyCommand != "":
+		fmt.Fprintf(w, "\tProxyCommand %s\n", proxyCommand)
+	default:
+		fmt.Fprint(w, "\tProxyJump none\n")
+	}
+	if p.Insecure {
+		fmt.Fprint(w, "\tStrictHostKeyChecking no\n")
+		fmt.Fprint(w, "\tUserKnownHostsFile /dev/null\n")
+	} else {
+		files := p.KnownHostsFiles
+		if files == nil {
+			files = []string{"~/.ssh/known_hosts"}
+		}
+		if p.HostCA != "" {
+			caFile, err := n.hostCAFile(p.HostCA, hostCAFiles)
+			if err != nil {
+				return err
+			}
+			if caFile != "" {
+				files = append(files, caFile)
+			}
+		}
+		quoted := make([]string, 0, len(files))
+		for _, f := range files {
+			quoted = append(quoted, configQuote(f))
+		}
+		fmt.Fprintf(w, "\tUserKnownHostsFile %s\n", strings.Join(quoted, " "))
+	}
+	if p.ServerAliveInterval > 0 {
+		fmt.Fprintf(w, "\tServerAliveInterval %d\n", int(p.ServerAliveInterval.Seconds()))
+		fmt.Fprintf(w, "\tServerAliveCountMax %d\n", p.ServerAliveCountMax)
+	}
+	return nil
+}
+
+// hostCAFile writes the host CA public key in the known_hosts format, as a
+// @cert-authority for all hosts. It returns an empty path when the host CA
+// public key is not available.
+func (n *nativeEnv) hostCAFile(hostCA string, hostCAFiles map[string]string) (string, error) {
+	if f, ok := hostCAFiles[hostCA]; ok {
+		return f, nil
+	}
+	content, err := ioutil.ReadFile(hostCA)
+	if os.IsNotExist(err) {
+		hostCAFiles[hostCA] = ""
+		return "", nil
+	}
 	if err != nil {
-		return err
+		return "", err
+	}
+	var b bytes.Buffer
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			fmt.Fprintf(&b, "@cert-authority * %s\n", line)
+		}
 	}
-	certPath, err := writeCert(dir, cert)
-	defer func() { _ = os.Remove(certPath) }()
+	f := filepath.Join(n.dir, fmt.Sprintf("known_hosts_ca-%d", len(hostCAFiles)))
+	err = ioutil.WriteFile(f, b.Bytes(), 0600)
 	if err != nil {
-		return err
+		return "", err
 	}
+	hostCAFiles[hostCA] = f
+	return f, nil
+}
 
-	var allArgs []string
-	if verbose {
-		allArgs = append(allArgs, "-v")
-	}
-	if terminal {
-		allArgs = append(allArgs, "-t")
-	}
-
-	if sshParams.Insecure {
-		allArgs = append(
-			allArgs,
-			"-o", "StrictHostKeyChecking=no",
-			"-o", "UserKnownHostsFile=/dev/null",
-		)
-	}
-	allArgs = append(
-		allArgs,
-		"-o", fmt.Sprintf("IdentityFile=%s", privkeyPath),
-		"-o", fmt.Sprintf("CertificateFile=%s", certPath),
-		"-o", "IdentitiesOnly=yes",
-		"-o", "IdentityAgent=none",
-		"-o", "AddKeysToAgent=no",
-		"-o", "ForwardAgent=no",
-		"-l", strings.Replace(sshParams.LoginName, " ", `\ `, -1),
-		"-p", fmt.Sprintf("%d", sshParams.Port),
-		sshParams.Host,
-	)
-	if len(env) != 0 {
-		var pre []string
-		pre = append(pre, "env")
-		pre = append(pre, sys.EscapeEnv(env)...)
-		if len(sshParams.Commands) == 0 {
-			pre = append([]string{"-t"}, pre...)
-			pre = append(pre, "bash")
-		}
-		allArgs = append(allArgs, pre...)
-	}
-	allArgs = append(allArgs, sshParams.Commands...)
-
-	cmd := exec.CommandContext(ctx, "ssh", allArgs...)
+// nativeHostName returns the name of a host in the generated ssh_config: the
+// host as given on the command line, so that the Host sections of the
+// included ssh_config files still match, or the alias when the name is
+// already taken by another hop.
+func nativeHostName(p params.SSHParams, alias string, names map[string]bool) string {
+	name := p.OriginalHost
+	if names[name] || strings.ContainsAny(name, " \t*?!,") {
+		name = alias
+	}
+	names[name] = true
+	return name
+}
+
+// configQuote quotes a ssh_config value that contains blanks.
+func configQuote(s string) string {
+	if strings.ContainsAny(s, " \t#") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// remoteArgs prefixes the arguments that start with a colon with the name of
+// the destination: they are the remote paths.
+func (n *nativeEnv) remoteArgs(args []string) []string {
+	host := n.host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	remote := make([]string, 0, len(args))
+	for _, arg := range args {
+		if strings.HasPrefix(arg, ":") {
+			arg = host + arg
+		}
+		remote = append(remote, arg)
+	}
+	return remote
+}
+
+func nativeCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// NativeConnect opens a SSH session with the native ssh client.
+func NativeConnect(ctx context.Context, sshParams params.SSHParams, terminal, verbose bool, credentials []crypto.SSHCredentials, secrets params.Secrets, l *zap.SugaredLogger) error {
+	if len(secrets.Files) > 0 {
+		return errors.New("secret files are not supported with the native ssh client")
+	}
+	n, err := newNativeEnv(ctx, sshParams, credentials, l)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+
+	opts := []string{"-F", n.config}
+	if verbose {
+		opts = append(opts, "-v")
+	}
+	if terminal && !sshParams.NoTerminal {
+		opts = append(opts, "-t")
+	}
+	if sshParams.NoTerminal {
+		opts = append(opts, "-T")
+	}
+	if sshParams.Subsystem {
+		if len(secrets.Env) > 0 && secrets.Mode != params.SecretModeSetenv {
+			return errors.New("the secrets are passed to a subsystem with the setenv secret mode only")
+		}
+		opts = append(opts, "-s")
+	}
+	if sshParams.ForwardAgent {
+		// the agent of ssh is the keyring of the credentials: the local agent
+		// is forwarded by path
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			opts = append(opts, "-o", "ForwardAgent="+configQuote(sock))
+		} else {
+			l.Warnw("no agent to forward: SSH_AUTH_SOCK is not set")
+		}
+	}
+	forwardOptions := map[string]string{
+		params.LocalForward:   "-L",
+		params.RemoteForward:  "-R",
+		params.DynamicForward: "-D",
+	}
+	for _, fwd := range sshParams.Forwards {
+		opts = append(opts, forwardOptions[fwd.Type], fwd.Spec)
+	}
+	if len(sshParams.Forwards) > 0 {
+		// like the builtin client
+		opts = append(opts, "-o", "ExitOnForwardFailure=yes")
+	}
+	if sshParams.NoSession {
+		opts = append(opts, "-N")
+	}
+	remote := sshParams.Commands
+	cmd := nativeCommand(ctx, "ssh")
+
+	switch secrets.Mode {
+	case "", params.SecretModeEnv:
+		if len(secrets.Env) != 0 {
+			remote = append([]string{"env"}, sys.EscapeEnv(secrets.Env)...)
+			if len(sshParams.Commands) == 0 && !sshParams.NoTerminal {
+				opts = append(opts, "-t")
+				remote = append(remote, "bash")
+			}
+			remote = append(remote, sshParams.Commands...)
+		}
+	case params.SecretModeSetenv:
+		// the values are passed in the environment of the local ssh process,
+		// and sent with SendEnv
+		cmd.Env = os.Environ()
+		for k, v := range secrets.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+			opts = append(opts, "-o", "SendEnv="+k)
+		}
+	case params.SecretModeStdin:
+		if (terminal || len(sshParams.Commands) == 0) && !sshParams.NoTerminal {
+			return errors.New("the stdin secret mode needs a remote command and no pseudo-terminal")
+		}
+		script := exportScript(secrets.Env)
+		defer memguard.WipeBytes(script)
+		remote = []string{stdinWrapper(strings.Join(sshParams.Commands, " "), len(script))}
+		cmd.Stdin = io.MultiReader(bytes.NewReader(script), os.Stdin)
+	default:
+		return fmt.Errorf("unknown secret mode: %s", secrets.Mode)
+	}
+
+	opts = append(opts, "--", n.host)
+	cmd.Args = append(append(cmd.Args, opts...), remote...)
 	return cmd.Run()
 }
+
+// NativeSCP runs the native scp client. The arguments that start with a colon
+// are the remote paths.
+func NativeSCP(ctx context.Context, sshParams params.SSHParams, verbose bool, credentials []crypto.SSHCredentials, args []string, l *zap.SugaredLogger) error {
+	n, err := newNativeEnv(ctx, sshParams, credentials, l)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+	opts := []string{"-F", n.config}
+	if verbose {
+		opts = append(opts, "-v")
+	}
+	return nativeCommand(ctx, "scp", append(opts, n.remoteArgs(args)...)...).Run()
+}
+
+// NativeSFTP runs the native sftp client, with the given sftp options.
+func NativeSFTP(ctx context.Context, sshParams params.SSHParams, verbose bool, credentials []crypto.SSHCredentials, args []string, l *zap.SugaredLogger) error {
+	n, err := newNativeEnv(ctx, sshParams, credentials, l)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+	opts := []string{"-F", n.config}
+	if verbose {
+		opts = append(opts, "-v")
+	}
+	opts = append(append(opts, args...), n.host)
+	return nativeCommand(ctx, "sftp", opts...).Run()
+}
+
+// NativeRsync runs rsync over the native ssh client. The arguments that start
+// with a colon are the remote paths.
+func NativeRsync(ctx context.Context, sshParams params.SSHParams, verbose bool, credentials []crypto.SSHCredentials, args []string, l *zap.SugaredLogger) error {
+	n, err := newNativeEnv(ctx, sshParams, credentials, l)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+	rsh := "ssh -F " + strconv.Quote(n.config)
+	if verbose {
+		rsh += " -v"
+	}
+	return nativeCommand(ctx, "rsync", append([]string{"-e", rsh}, n.remoteArgs(args)...)...).Run()
+}
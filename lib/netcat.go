@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Netcat joins the local stdin and stdout to a connection opened by the SSH
+// server, like ssh -W: to a TCP address (direct-tcpip), or to a unix socket
+// (direct-streamlocal). It returns when the target closes the connection.
+func Netcat(ctx context.Context, client *ssh.Client, network, addr string, l *zap.SugaredLogger) error {
+	conn, err := client.Dial(network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %s", addr, err)
+	}
+	defer func() { _ = conn.Close() }()
+	l.Debugw("connected to the target", "network", network, "address", addr)
+
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		// the target may still answer after the end of stdin
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,278 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+)
+
+// dialFunc opens the transport connection to a SSH server.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// transportDialer returns the function that opens the connection to the SSH
+// server of cfg: through the proxy command, the SOCKS5 proxy or the HTTP
+// proxy, in that order of precedence, and else directly.
+func transportDialer(cfg gssh.Config, sshParams params.SSHParams, l *zap.SugaredLogger) dialFunc {
+	switch {
+	case sshParams.ProxyCommand != "":
+		command := expandProxyCommand(sshParams.ProxyCommand, cfg)
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			l.Debugw("connecting through proxy command", "command", command)
+			return dialCommand(command)
+		}
+	case sshParams.Proxy != nil:
+		return socks5Dialer(sshParams.Proxy)
+	case sshParams.HTTPProxy != nil:
+		return gssh.NewHTTPConnectProxy(sshParams.HTTPProxy).DialContext
+	default:
+		var d net.Dialer
+		return d.DialContext
+	}
+}
+
+// expandProxyCommand replaces the tokens of a ProxyCommand: %h (host), %p
+// (port), %r (remote user) and %%.
+func expandProxyCommand(command string, cfg gssh.Config) string {
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", cfg.Host,
+		"%p", strconv.Itoa(cfg.GetPort()),
+		"%r", cfg.User,
+	).Replace(command)
+}
+
+// commandConn is a connection to the stdin and stdout of a proxy command.
+type commandConn struct {
+	net.Conn
+	cmd *exec.Cmd
+}
+
+// dialCommand starts the proxy command with the user shell, like OpenSSH
+// does. The command stderr goes to the vssh stderr.
+func dialCommand(command string) (net.Conn, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell, "-c", "exec "+command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start proxy command: %s", err)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		_, _ = io.Copy(stdin, remote)
+		_ = stdin.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(remote, stdout)
+		_ = remote.Close()
+	}()
+	return &commandConn{Conn: local, cmd: cmd}, nil
+}
+
+// Close closes the connection and stops the proxy command.
+func (c *commandConn) Close() error {
+	err := c.Conn.Close()
+	if c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+	}
+	_ = c.cmd.Wait()
+	return err
+}
+
+// socks5Dialer returns a dialFunc that connects through a SOCKS5 proxy
+// (RFC 1928), with the username and password of the proxy URL if any
+// (RFC 1929).
+func socks5Dialer(proxy *url.URL) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+		if proxy.Scheme == "socks5" && net.ParseIP(host) == nil {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("no address for %s", host)
+			}
+			host = addrs[0].IP.String()
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", proxy.Host)
+		if err != nil {
+			return nil, err
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(30 * time.Second)
+		}
+		_ = conn.SetDeadline(deadline)
+		err = socks5Connect(conn, proxy.User, host, port)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("SOCKS5 proxy %s: %s", proxy.Host, err)
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5PasswordAuth = 2
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 1
+	socks5IPv4         = 1
+	socks5DomainName   = 3
+	socks5IPv6         = 4
+)
+
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect negotiates the authentication with the SOCKS5 proxy, and asks
+// it to connect to host:port.
+func socks5Connect(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = append(methods, socks5PasswordAuth)
+	}
+	_, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5PasswordAuth:
+		if user == nil {
+			return errors.New("the proxy asks for a username and password")
+		}
+		err = socks5Authenticate(conn, user)
+		if err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socks5DomainName, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	var portBytes [2]byte
+	binary.BigEndian.PutUint16(portBytes[:], uint16(port))
+	req = append(req, portBytes[:]...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		if msg, ok := socks5Errors[header[1]]; ok {
+			return fmt.Errorf("connection to %s failed: %s", net.JoinHostPort(host, strconv.Itoa(port)), msg)
+		}
+		return fmt.Errorf("connection to %s failed: error %d", net.JoinHostPort(host, strconv.Itoa(port)), header[1])
+	}
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len + 2
+	case socks5IPv6:
+		skip = net.IPv6len + 2
+	case socks5DomainName:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("unexpected address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// socks5Authenticate sends the username and password to the proxy.
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("proxy username or password too long")
+	}
+	req := []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// socks5Exchange is what a fake SOCKS5 proxy received from the client.
+type socks5Exchange struct {
+	greeting []byte
+	auth     []byte
+	request  []byte
+}
+
+// fakeSOCKS5 answers a SOCKS5 client with method, authStatus when the
+// password authentication is chosen, and reply to the connect request.
+func fakeSOCKS5(conn net.Conn, method, authStatus byte, reply []byte) socks5Exchange {
+	var ex socks5Exchange
+	defer func() { _ = conn.Close() }()
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		return b
+	}
+	ex.greeting = read(2)
+	if ex.greeting == nil {
+		return ex
+	}
+	ex.greeting = append(ex.greeting, read(int(ex.greeting[1]))...)
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return ex
+	}
+	if method == socks5PasswordAuth {
+		ex.auth = read(2)
+		if ex.auth == nil {
+			return ex
+		}
+		ex.auth = append(ex.auth, read(int(ex.auth[1]))...)
+		plen := read(1)
+		if plen == nil {
+			return ex
+		}
+		ex.auth = append(append(ex.auth, plen...), read(int(plen[0]))...)
+		if _, err := conn.Write([]byte{1, authStatus}); err != nil {
+			return ex
+		}
+	}
+	ex.request = read(4)
+	if ex.request == nil {
+		return ex
+	}
+	switch ex.request[3] {
+	case socks5IPv4:
+		ex.request = append(ex.request, read(net.IPv4len+2)...)
+	case socks5IPv6:
+		ex.request = append(ex.request, read(net.IPv6len+2)...)
+	case socks5DomainName:
+		l := read(1)
+		ex.request = append(append(ex.request, l...), read(int(l[0])+2)...)
+	}
+	_, _ = conn.Write(reply)
+	return ex
+}
+
+func TestSocks5Connect(t *testing.T) {
+	ipv4Reply := []byte{5, 0, 0, socks5IPv4, 192, 0, 2, 1, 0x04, 0x38}
+	banner := "SSH-2.0-test\r\n"
+	tests := []struct {
+		name         string
+		user         *url.Userinfo
+		host         string
+		port         int
+		method       byte
+		authStatus   byte
+		reply        []byte
+		wantGreeting []byte
+		wantAuth     []byte
+		wantRequest  []byte
+		wantErr      string
+	}{
+		{
+			name:         "IPv4",
+			host:         "10.0.0.1",
+			port:         22,
+			reply:        ipv4Reply,
+			wantGreeting: []byte{5, 1, socks5NoAuth},
+			wantRequest:  []byte{5, socks5CmdConnect, 0, socks5IPv4, 10, 0, 0, 1, 0, 22},
+		},
+		{
+			name:         "IPv6",
+			host:         "2001:db8::1",
+			port:         2222,
+			reply:        append([]byte{5, 0, 0, socks5IPv6}, append(net.ParseIP("2001:db8::2"), 0, 80)...),
+			wantGreeting: []byte{5, 1, socks5NoAuth},
+			wantRequest:  append([]byte{5, socks5CmdConnect, 0, socks5IPv6}, append(net.ParseIP("2001:db8::1"), 0x08, 0xae)...),
+		},
+		{
+			name:         "host name",
+			host:         "ssh.internal",
+			port:         22,
+			reply:        []byte{5, 0, 0, socks5DomainName, 5, 'p', 'r', 'o', 'x', 'y', 0, 80},
+			wantGreeting: []byte{5, 1, socks5NoAuth},
+			wantRequest:  append(append([]byte{5, socks5CmdConnect, 0, socks5DomainName, 12}, "ssh.internal"...), 0, 22),
+		},
+		{
+			name:         "password",
+			user:         url.UserPassword("alice", "secret"),
+			host:         "10.0.0.1",
+			port:         22,
+			method:       socks5PasswordAuth,
+			reply:        ipv4Reply,
+			wantGreeting: []byte{5, 2, socks5NoAuth, socks5PasswordAuth},
+			wantAuth:     append(append([]byte{1, 5}, "alice"...), append([]byte{6}, "secret"...)...),
+			wantRequest:  []byte{5, socks5CmdConnect, 0, socks5IPv4, 10, 0, 0, 1, 0, 22},
+		},
+		{
+			name:       "wrong password",
+			user:       url.UserPassword("alice", "wrong"),
+			host:       "10.0.0.1",
+			port:       22,
+			method:     socks5PasswordAuth,
+			authStatus: 1,
+			wantErr:    "authentication failed",
+		},
+		{
+			name:    "password without user",
+			host:    "10.0.0.1",
+			port:    22,
+			method:  socks5PasswordAuth,
+			wantErr: "asks for a username and password",
+		},
+		{
+			name:    "no acceptable method",
+			host:    "10.0.0.1",
+			port:    22,
+			method:  socks5NoAcceptable,
+			wantErr: "no acceptable authentication method",
+		},
+		{
+			name:    "connection refused",
+			host:    "10.0.0.1",
+			port:    22,
+			reply:   []byte{5, 5, 0, socks5IPv4, 0, 0, 0, 0, 0, 0},
+			wantErr: "connection to 10.0.0.1:22 failed: connection refused",
+		},
+		{
+			name:    "unknown error",
+			host:    "10.0.0.1",
+			port:    22,
+			reply:   []byte{5, 42, 0, socks5IPv4, 0, 0, 0, 0, 0, 0},
+			wantErr: "error 42",
+		},
+		{
+			name:    "unexpected address type",
+			host:    "10.0.0.1",
+			port:    22,
+			reply:   []byte{5, 0, 0, 9},
+			wantErr: "unexpected address type 9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			done := make(chan socks5Exchange, 1)
+			go func() {
+				// the banner of the SSH server follows the reply
+				done <- fakeSOCKS5(server, tt.method, tt.authStatus, append(append([]byte{}, tt.reply...), banner...))
+			}()
+			err := socks5Connect(client, tt.user, tt.host, tt.port)
+			if tt.wantErr != "" {
+				_ = client.Close()
+				<-done
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rest, err := ioutil.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != banner {
+				t.Errorf("the connection reads %q after the reply, want %q", rest, banner)
+			}
+			ex := <-done
+			if !bytes.Equal(ex.greeting, tt.wantGreeting) {
+				t.Errorf("greeting = %v, want %v", ex.greeting, tt.wantGreeting)
+			}
+			if !bytes.Equal(ex.auth, tt.wantAuth) {
+				t.Errorf("authentication = %v, want %v", ex.auth, tt.wantAuth)
+			}
+			if !bytes.Equal(ex.request, tt.wantRequest) {
+				t.Errorf("request = %v, want %v", ex.request, tt.wantRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// shmDir is the remote memory-backed directory that is preferred to store the
+// secret files.
+const shmDir = "/dev/shm"
+
+// writeSecretFiles writes the secret files on the remote host. When /dev/shm
+// exists, the content is stored there, and the requested paths are symlinks to
+// it. The returned function removes everything that was written.
+func writeSecretFiles(conn *ssh.Client, files []params.SecretFile, l *zap.SugaredLogger) (func(), error) {
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SFTP session: %s", err)
+	}
+	var toRemove []string
+	var dir string
+	cleanup := func() {
+		for i := len(toRemove) - 1; i >= 0; i-- {
+			err := client.Remove(toRemove[i])
+			if err != nil {
+				l.Warnw("failed to remove remote secret file", "path", toRemove[i], "error", err)
+			}
+		}
+		if dir != "" {
+			_ = client.RemoveDirectory(dir)
+		}
+		_ = client.Close()
+	}
+	var written bool
+	defer func() {
+		if !written {
+			cleanup()
+		}
+	}()
+
+	if infos, err := client.Stat(shmDir); err == nil && infos.IsDir() {
+		var random [8]byte
+		_, err := rand.Read(random[:])
+		if err != nil {
+			return nil, err
+		}
+		dir = path.Join(shmDir, "vssh-"+hex.EncodeToString(random[:]))
+		err = client.Mkdir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %s", dir, err)
+		}
+		err = client.Chmod(dir, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to chmod %s: %s", dir, err)
+		}
+	}
+
+	for i, f := range files {
+		// relative paths are resolved from the home directory by the SFTP server
+		target := strings.TrimPrefix(f.Path, "~/")
+		if _, err := client.Lstat(target); err == nil {
+			return nil, fmt.Errorf("remote file %s already exists", f.Path)
+		}
+		content := target
+		if dir != "" {
+			content = path.Join(dir, fmt.Sprintf("%d-%s", i, path.Base(target)))
+		}
+		err := writeSecretFile(client, content, f)
+		if err != nil {
+			return nil, err
+		}
+		toRemove = append(toRemove, content)
+		if content != target {
+			err = client.Symlink(content, target)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create symlink %s: %s", f.Path, err)
+			}
+			toRemove = append(toRemove, target)
+		}
+		l.Debugw("remote secret file written", "path", f.Path, "content", content)
+	}
+	written = true
+	return cleanup, nil
+}
+
+func writeSecretFile(client *sftp.Client, name string, f params.SecretFile) error {
+	file, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to create remote file %s: %s", name, err)
+	}
+	// restrict the permissions before the content is written
+	err = client.Chmod(name, f.Mode)
+	if err == nil {
+		_, err = file.Write(f.Content.Buffer())
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = client.Remove(name)
+		return fmt.Errorf("failed to write remote file %s: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/awnumar/memguard"
+	"github.com/moby/moby/pkg/term"
+	gssh "github.com/stephane-martin/golang-ssh"
+	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/sys"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sync/errgroup"
+)
+
+// AcceptEnvError is returned when the SSH server refuses an environment variable.
+type AcceptEnvError struct {
+	Name string
+}
+
+func (e AcceptEnvError) Error() string {
+	return fmt.Sprintf("the SSH server refused the environment variable %s: it must be allowed by AcceptEnv in the server sshd_config", e.Name)
+}
+
+// goConnectSession runs the remote command or shell in a session. It passes
+// the secrets according to the secret mode, and writes the secret files for
+// the duration of the session. A remote command without a pseudo-terminal
+// gets the local stdin, and the local signals. A subsystem only gets the
+// secrets with the setenv mode. The port forwardings run on the same
+// connection, until the session ends. When the remote command fails, the
+// error is a *ssh.ExitError.
+func goConnectSession(ctx context.Context, cfg gssh.Config, sshParams params.SSHParams, terminal bool, secrets params.Secrets, l *zap.SugaredLogger) error {
+	command := strings.Join(sshParams.Commands, " ")
+	interactive := (terminal || command == "") && !sshParams.NoTerminal && !sshParams.NoSession
+	if sshParams.Subsystem {
+		if command == "" {
+			return errors.New("no subsystem name")
+		}
+		if len(secrets.Env) > 0 && secrets.Mode != params.SecretModeSetenv {
+			return errors.New("the secrets are passed to a subsystem with the setenv secret mode only")
+		}
+		// the subsystem name is not a shell command that could pass them
+		secrets.Mode = params.SecretModeSetenv
+	}
+	if secrets.Mode == params.SecretModeStdin && interactive {
+		return errors.New("the stdin secret mode needs a remote command and no pseudo-terminal")
+	}
+
+	conn, err := Dial(ctx, cfg, sshParams, l)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	if len(secrets.Files) > 0 {
+		cleanup, err := writeSecretFiles(conn, secrets.Files, l)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+	if len(sshParams.Forwards) > 0 {
+		fctx, stopForwards := context.WithCancel(ctx)
+		defer stopForwards()
+		err := startForwards(fctx, conn, sshParams.Forwards, l)
+		if err != nil {
+			return err
+		}
+	}
+	if sshParams.NoSession {
+		// only the forwardings run, until vssh is interrupted or the
+		// connection closes
+		closed := make(chan error, 1)
+		go func() { closed <- conn.Wait() }()
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			return err
+		}
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Close() }()
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	if sshParams.ForwardAgent {
+		forwardAgent(conn, session, l)
+	}
+
+	switch secrets.Mode {
+	case "", params.SecretModeEnv:
+		if len(secrets.Env) != 0 {
+			if command == "" {
+				command = "bash"
+			}
+			command = "env " + strings.Join(sys.EscapeEnv(secrets.Env), " ") + " " + command
+		}
+	case params.SecretModeSetenv:
+		err := setenv(session, secrets.Env)
+		if err != nil {
+			return err
+		}
+	case params.SecretModeStdin:
+		script := exportScript(secrets.Env)
+		defer memguard.WipeBytes(script)
+		command = stdinWrapper(command, len(script))
+		session.Stdin = io.MultiReader(bytes.NewReader(script), os.Stdin)
+	}
+
+	lctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if interactive {
+		restore, err := requestPty(session)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		go func() {
+			select {
+			case <-lctx.Done():
+			case <-ctx.Done():
+				_ = session.Close()
+			}
+		}()
+		go monitorWindow(lctx, session)
+	} else {
+		// the signals go to the remote command, instead of canceling ctx and
+		// the port forwardings
+		sigs := notifyForwardedSignals()
+		sys.ReleaseSignals(ctx)
+		go forwardSignals(lctx, session, sigs)
+	}
+	if sshParams.Subsystem {
+		return runSubsystem(session, command)
+	}
+	if command != "" {
+		return session.Run(command)
+	}
+	err = session.Shell()
+	if err != nil {
+		return err
+	}
+	return session.Wait()
+}
+
+// runSubsystem runs the subsystem with the standard streams of the session.
+// The session can not wait for a subsystem: runSubsystem returns when the
+// subsystem closes its output, without its exit status.
+func runSubsystem(session *ssh.Session, name string) error {
+	stdin, stdout, stderr := session.Stdin, session.Stdout, session.Stderr
+	session.Stdin, session.Stdout, session.Stderr = nil, nil, nil
+	in, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	errOut, err := session.StderrPipe()
+	if err != nil {
+		return err
+	}
+	err = session.RequestSubsystem(name)
+	if err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(in, stdin)
+		_ = in.Close()
+	}()
+	var g errgroup.Group
+	g.Go(func() error {
+		_, err := io.Copy(stdout, out)
+		return err
+	})
+	g.Go(func() error {
+		_, err := io.Copy(stderr, errOut)
+		return err
+	})
+	return g.Wait()
+}
+
+// forwardAgent forwards the local SSH agent to the session. Like ssh, the
+// session goes on when the agent can not be forwarded.
+func forwardAgent(conn *ssh.Client, session *ssh.Session, l *zap.SugaredLogger) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		l.Warnw("no agent to forward: SSH_AUTH_SOCK is not set")
+		return
+	}
+	err := agent.ForwardToRemote(conn, sock)
+	if err == nil {
+		err = agent.RequestAgentForwarding(session)
+	}
+	if err != nil {
+		l.Warnw("agent forwarding failed", "error", err)
+	}
+}
+
+// setenv sends the environment variables as SSH env requests.
+func setenv(session *ssh.Session, env map[string]string) error {
+	for k, v := range env {
+		err := session.Setenv(k, v)
+		if err != nil {
+			return AcceptEnvError{Name: k}
+		}
+	}
+	return nil
+}
+
+// exportScript returns the shell commands that export the environment variables.
+func exportScript(env map[string]string) []byte {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var script bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&script, "export %s=%s\n", k, sys.EscapeString(env[k]))
+	}
+	return script.Bytes()
+}
+
+// stdinWrapper returns the remote command that reads the export script on
+// stdin, and then executes command. Exactly scriptLen bytes are read, so that
+// the rest of stdin is left to command.
+func stdinWrapper(command string, scriptLen int) string {
+	return fmt.Sprintf(
+		`eval "$(dd bs=1 count=%d 2>/dev/null)" || exit 1; exec sh -c %s`,
+		scriptLen,
+		sys.EscapeString(command),
+	)
+}
+
+// requestPty allocates a pseudo-terminal of the local terminal type ($TERM,
+// or xterm) for the session. The local terminal is put in raw mode until
+// restore is called.
+func requestPty(session *ssh.Session) (restore func(), err error) {
+	restore = func() {}
+	width, height := 80, 24
+	fd := os.Stdin.Fd()
+	if term.IsTerminal(fd) {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return restore, err
+		}
+		restore = func() { _ = term.RestoreTerminal(fd, oldState) }
+		if winsize, err := term.GetWinsize(fd); err == nil {
+			width, height = int(winsize.Width), int(winsize.Height)
+		}
+	}
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm"
+	}
+	err = session.RequestPty(termType, height, width, ssh.TerminalModes{ssh.ECHO: 1})
+	if err != nil {
+		restore()
+		return func() {}, err
+	}
+	return restore, nil
+}
+
+// forwardedSignals are the local signals that are sent to the remote command.
+var forwardedSignals = map[os.Signal]ssh.Signal{
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// notifyForwardedSignals returns the channel of the signals that are sent to
+// the remote command.
+func notifyForwardedSignals() chan os.Signal {
+	sigs := make(chan os.Signal, 1)
+	for sig := range forwardedSignals {
+		signal.Notify(sigs, sig)
+	}
+	return sigs
+}
+
+// forwardSignals sends the signals of sigs to the remote command. As some SSH
+// servers ignore the signal requests, a second SIGINT or SIGTERM closes the
+// session.
+func forwardSignals(ctx context.Context, session *ssh.Session, sigs chan os.Signal) {
+	defer signal.Stop(sigs)
+	var interrupted bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigs:
+			_ = session.Signal(forwardedSignals[sig])
+			if sig != syscall.SIGINT && sig != syscall.SIGTERM {
+				continue
+			}
+			if interrupted {
+				_ = session.Close()
+				return
+			}
+			interrupted = true
+		}
+	}
+}
+
+// monitorWindow forwards the local terminal size changes to the session.
+func monitorWindow(ctx context.Context, session *ssh.Session) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			winsize, err := term.GetWinsize(os.Stdout.Fd())
+			if err != nil {
+				continue
+			}
+			size := make([]byte, 16)
+			binary.BigEndian.PutUint32(size, uint32(winsize.Width))
+			binary.BigEndian.PutUint32(size[4:], uint32(winsize.Height))
+			_, _ = session.SendRequest("window-change", false, size)
+		}
+	}
+}
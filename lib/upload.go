@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/stephane-martin/vssh/crypto"
 	"github.com/stephane-martin/vssh/params"
 	"github.com/stephane-martin/vssh/sys"
 
@@ -106,12 +107,12 @@ func SFTPPutAuth(ctx context.Context, sources []Source, remotePath string, gpara
 		Auth:      auth,
 		HTTPProxy: gparams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
+	hkcb, err := crypto.MakeHostKeyCallback(gparams, l)
 	if err != nil {
 		return err
 	}
 	cfg.HostKey = hkcb
-	client, err := gssh.SFTP(ctx, cfg)
+	client, err := sftpClient(ctx, cfg, gparams, l)
 	if err != nil {
 		return err
 	}
@@ -261,7 +262,7 @@ func ScpPutAuth(ctx context.Context, sources []Source, remotePath string, gparam
 		Auth:      auth,
 		HTTPProxy: gparams.HTTPProxy,
 	}
-	hkcb, err := gssh.MakeHostKeyCallback(gparams.Insecure, l)
+	hkcb, err := crypto.MakeHostKeyCallback(gparams, l)
 	if err != nil {
 		return err
 	}
@@ -282,7 +283,7 @@ func ScpPutAuth(ctx context.Context, sources []Source, remotePath string, gparam
 	}
 	command := fmt.Sprintf("scp %s %s", opts, p)
 	l.Debugw("remote command", "cmd", command)
-	client, err := gssh.StartCommand(ctx, cfg, command)
+	client, err := startCommand(ctx, cfg, gparams, command, l)
 	if err != nil {
 		return err
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 
 	"github.com/stephane-martin/vssh/sys"
 
@@ -24,6 +25,10 @@ func main() {
 			os.Exit(code)
 		}
 	}
+	// invoked as ssh, vssh takes the options of the OpenSSH client
+	if filepath.Base(os.Args[0]) == "ssh" {
+		os.Args = append([]string{os.Args[0], "ssh-compat"}, os.Args[1:]...)
+	}
 	sys.StartAgent()
 	_ = app.Run(os.Args)
 	sys.StopAgent()
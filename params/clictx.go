@@ -1,6 +1,10 @@
 package params
 
-import "github.com/urfave/cli"
+import (
+	"os"
+
+	"github.com/urfave/cli"
+)
 
 type CLIContext interface {
 	VaultAddress() string
@@ -11,29 +15,101 @@ type CLIContext interface {
 	VaultPassword() string
 	VaultSSHMount() string
 	VaultSSHRole() string
+	VaultSSHHostMount() string
+	VaultCACert() string
+	VaultClientCert() string
+	VaultClientKey() string
+	VaultTLSSkipVerify() bool
+	VaultNamespace() string
+	VaultAuthRole() string
+	VaultJWT() string
+	VaultJWTFile() string
+	VaultTokenHelper() string
+	VaultOTPMount() string
+	VaultOTPRole() string
 	SSHHost() string
 	SSHCommand() []string
+	SSHOptions() []string
 	SSHLogin() string
 	SSHPort() int
+	SSHConfigFile() string
+	SSHJump() string
+	ForJumpHost(host string, port int) CLIContext
 	SSHPassword() bool
 	SSHAgent() bool
 	SSHInsecure() bool
 	HTTPProxy() string
-	PrivateKey() string
+	Proxy() string
+	ProxyCommand() string
+	ControlPath() string
+	ControlPersist() string
+	ControlMasterArgs() []string
+	PrivateKeys() []string
 	VPrivateKey() string
+	Ephemeral() bool
+	CertTTL() string
+	CertKeyID() string
+	CertPrincipals() []string
+	CertExtensions() []string
+	CertForceCommand() string
+	CertSourceAddress() string
+	LocalCA() string
+	KnownHostsFiles() []string
+	Profile() string
 	ForceTerminal() bool
 }
 
-func NewCliContext(ctx *cli.Context) CLIContext {
-	return cliContext{ctx: ctx}
+// NewCliContext returns the options of the command line. The options that are
+// not given on the command line or in the environment are taken from the
+// profile, chosen with --profile or by matching the host.
+func NewCliContext(ctx *cli.Context) (CLIContext, error) {
+	config, err := ReadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return nil, err
+	}
+	c := cliContext{ctx: ctx, config: config}
+	profile, err := config.SelectProfile(ctx.GlobalString("profile"), c.SSHHost())
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		c.profile = *profile
+	}
+	return c, nil
 }
 
 type cliContext struct {
-	ctx *cli.Context
+	ctx     *cli.Context
+	config  Config
+	profile Profile
+	hop     *jumpHost
+}
+
+type jumpHost struct {
+	host string
+	port int
+}
+
+// stringOption returns the value of the flag when it is set, and else the
+// value of the profile, if any.
+func (c cliContext) stringOption(name, profileValue string) string {
+	if profileValue != "" && !c.ctx.GlobalIsSet(name) {
+		return profileValue
+	}
+	return c.ctx.GlobalString(name)
+}
+
+// stringSliceOption returns the values of the flag when it is set, and else
+// the values of the profile, if any.
+func (c cliContext) stringSliceOption(name string, profileValues []string) []string {
+	if len(profileValues) > 0 && !c.ctx.GlobalIsSet(name) {
+		return profileValues
+	}
+	return c.ctx.GlobalStringSlice(name)
 }
 
 func (c cliContext) VaultAddress() string {
-	return c.ctx.GlobalString("vault-address")
+	return c.stringOption("vault-address", c.profile.VaultAddress)
 }
 
 func (c cliContext) VaultToken() string {
@@ -41,15 +117,15 @@ func (c cliContext) VaultToken() string {
 }
 
 func (c cliContext) VaultAuthMethod() string {
-	return c.ctx.GlobalString("vault-auth-method")
+	return c.stringOption("vault-auth-method", c.profile.VaultAuthMethod)
 }
 
 func (c cliContext) VaultAuthPath() string {
-	return c.ctx.GlobalString("vault-auth-path")
+	return c.stringOption("vault-auth-path", c.profile.VaultAuthPath)
 }
 
 func (c cliContext) VaultUsername() string {
-	return c.ctx.GlobalString("vault-username")
+	return c.stringOption("vault-username", c.profile.VaultUsername)
 }
 
 func (c cliContext) VaultPassword() string {
@@ -57,21 +133,82 @@ func (c cliContext) VaultPassword() string {
 }
 
 func (c cliContext) VaultSSHMount() string {
-	return c.ctx.GlobalString("vault-ssh-mount")
+	return c.stringOption("vault-ssh-mount", c.profile.VaultSSHMount)
 }
 
 func (c cliContext) VaultSSHRole() string {
-	return c.ctx.GlobalString("vault-ssh-role")
+	return c.stringOption("vault-ssh-role", c.profile.VaultSSHRole)
+}
+
+func (c cliContext) VaultSSHHostMount() string {
+	return c.stringOption("vault-ssh-host-mount", c.profile.VaultSSHHostMount)
+}
+
+func (c cliContext) VaultCACert() string {
+	return c.stringOption("vault-ca-cert", c.profile.VaultCACert)
+}
+
+func (c cliContext) VaultClientCert() string {
+	return c.stringOption("vault-client-cert", c.profile.VaultClientCert)
+}
+
+func (c cliContext) VaultClientKey() string {
+	return c.stringOption("vault-client-key", c.profile.VaultClientKey)
+}
+
+func (c cliContext) VaultTLSSkipVerify() bool {
+	return c.ctx.GlobalBool("vault-tls-skip-verify")
+}
+
+func (c cliContext) VaultNamespace() string {
+	return c.stringOption("vault-namespace", c.profile.VaultNamespace)
+}
+
+func (c cliContext) VaultAuthRole() string {
+	return c.stringOption("vault-auth-role", c.profile.VaultAuthRole)
+}
+
+func (c cliContext) VaultJWT() string {
+	return c.ctx.GlobalString("vault-jwt")
+}
+
+func (c cliContext) VaultJWTFile() string {
+	return c.ctx.GlobalString("vault-jwt-file")
+}
+
+func (c cliContext) VaultTokenHelper() string {
+	return c.stringOption("vault-token-helper", c.profile.VaultTokenHelper)
+}
+
+func (c cliContext) VaultOTPMount() string {
+	return c.stringOption("vault-otp-mount", c.profile.VaultOTPMount)
+}
+
+func (c cliContext) VaultOTPRole() string {
+	return c.stringOption("vault-otp-role", c.profile.VaultOTPRole)
 }
 
 func (c cliContext) SSHCommand() []string {
-	if len(c.ctx.Args()) == 0 {
+	if c.hop != nil || len(c.ctx.Args()) == 0 {
 		return nil
 	}
 	return c.ctx.Args()[1:]
 }
 
+// SSHOptions returns the ssh_config options given on the command line, that
+// take precedence over the ssh_config files. They do not apply to the jump
+// hosts.
+func (c cliContext) SSHOptions() []string {
+	if c.hop != nil {
+		return nil
+	}
+	return c.ctx.StringSlice("option")
+}
+
 func (c cliContext) SSHHost() string {
+	if c.hop != nil {
+		return c.hop.host
+	}
 	if len(c.ctx.Args()) == 0 {
 		return ""
 	}
@@ -79,14 +216,53 @@ func (c cliContext) SSHHost() string {
 }
 
 func (c cliContext) SSHLogin() string {
-	return c.ctx.GlobalString("login")
+	if c.hop != nil {
+		return c.profile.Login
+	}
+	return c.stringOption("login", c.profile.Login)
 }
 
 func (c cliContext) SSHPort() int {
+	if c.hop != nil {
+		if c.hop.port != 0 {
+			return c.hop.port
+		}
+		return c.profile.Port
+	}
+	if c.profile.Port != 0 && !c.ctx.GlobalIsSet("ssh-port") {
+		return c.profile.Port
+	}
 	return c.ctx.GlobalInt("ssh-port")
 }
 
+func (c cliContext) SSHJump() string {
+	if c.hop != nil {
+		return "none"
+	}
+	return c.ctx.GlobalString("jump")
+}
+
+// ForJumpHost returns the options for a jump host. The login and the port of
+// the command line only apply to the destination, and the profile is chosen
+// again for the jump host.
+func (c cliContext) ForJumpHost(host string, port int) CLIContext {
+	hop := c
+	hop.hop = &jumpHost{host: host, port: port}
+	if profile, _ := c.config.SelectProfile("", host); profile != nil {
+		hop.profile = *profile
+	}
+	return hop
+}
+
+func (c cliContext) SSHConfigFile() string {
+	return c.ctx.GlobalString("ssh-config")
+}
+
 func (c cliContext) SSHPassword() bool {
+	// asking for a password for every jump host would be confusing
+	if c.hop != nil {
+		return false
+	}
 	return c.ctx.GlobalBool("password")
 }
 
@@ -95,19 +271,103 @@ func (c cliContext) SSHAgent() bool {
 }
 
 func (c cliContext) SSHInsecure() bool {
+	if c.profile.Insecure && !c.ctx.GlobalIsSet("insecure") {
+		return true
+	}
 	return c.ctx.GlobalBool("insecure")
 }
 
 func (c cliContext) HTTPProxy() string {
-	return c.ctx.GlobalString("http-proxy")
+	return c.stringOption("http-proxy", c.profile.HTTPProxy)
+}
+
+func (c cliContext) Proxy() string {
+	return c.stringOption("proxy", c.profile.Proxy)
+}
+
+func (c cliContext) ProxyCommand() string {
+	return c.stringOption("proxy-command", c.profile.ProxyCommand)
+}
+
+// ControlPath returns the control master socket. The jump hosts connections
+// belong to the control master of the destination, so they have none.
+func (c cliContext) ControlPath() string {
+	if c.hop != nil {
+		return ""
+	}
+	return c.stringOption("control-path", c.profile.ControlPath)
+}
+
+func (c cliContext) ControlPersist() string {
+	return c.stringOption("control-persist", c.profile.ControlPersist)
+}
+
+// ControlMasterArgs returns the arguments that start the control master for
+// the host: the global options of the command line, and the hidden "control
+// master" command.
+func (c cliContext) ControlMasterArgs() []string {
+	root := c.ctx
+	for root.Parent() != nil {
+		root = root.Parent()
+	}
+	// the arguments of the root context start with the command name
+	global := os.Args[1 : len(os.Args)-len(root.Args())]
+	args := append([]string(nil), global...)
+	return append(args, "control", "master", c.SSHHost())
 }
 
-func (c cliContext) PrivateKey() string {
-	return c.ctx.GlobalString("privkey")
+func (c cliContext) PrivateKeys() []string {
+	return c.stringSliceOption("privkey", c.profile.PrivateKeys)
 }
 
 func (c cliContext) VPrivateKey() string {
-	return c.ctx.GlobalString("vprivkey")
+	return c.stringOption("vprivkey", c.profile.VPrivateKey)
+}
+
+func (c cliContext) Ephemeral() bool {
+	return c.ctx.GlobalBool("ephemeral")
+}
+
+func (c cliContext) CertTTL() string {
+	return c.stringOption("cert-ttl", c.profile.CertTTL)
+}
+
+func (c cliContext) CertKeyID() string {
+	return c.stringOption("cert-key-id", c.profile.CertKeyID)
+}
+
+func (c cliContext) CertPrincipals() []string {
+	return c.stringSliceOption("cert-principal", c.profile.CertPrincipals)
+}
+
+func (c cliContext) CertExtensions() []string {
+	return c.stringSliceOption("cert-extension", c.profile.CertExtensions)
+}
+
+func (c cliContext) CertForceCommand() string {
+	return c.stringOption("cert-force-command", c.profile.CertForceCommand)
+}
+
+func (c cliContext) CertSourceAddress() string {
+	return c.stringOption("cert-source-address", c.profile.CertSourceAddress)
+}
+
+func (c cliContext) LocalCA() string {
+	if c.profile.CA != nil {
+		return c.stringOption("local-ca", c.profile.CA.Key)
+	}
+	return c.ctx.GlobalString("local-ca")
+}
+
+// KnownHostsFiles returns the known_hosts files of the profile. They replace
+// the ones of ssh_config.
+func (c cliContext) KnownHostsFiles() []string {
+	return c.profile.KnownHosts
+}
+
+// Profile returns the name of the profile in use, if any.
+func (c cliContext) Profile() string {
+	return c.profile.Name
 }
 
 func (c cliContext) ForceTerminal() bool {
@@ -0,0 +1,53 @@
+package params
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// expandControlPath replaces the tokens of a control path, like the OpenSSH
+// ControlPath option: %h (host), %p (port), %r (remote user), %n (host as
+// given on the command line), %C (a hash of the connection) and %%.
+func expandControlPath(path, originalHost string, p SSHParams) (string, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+	if i := strings.LastIndex(originalHost, "@"); i >= 0 {
+		originalHost = originalHost[i+1:]
+	}
+	port := strconv.Itoa(p.Port)
+	local, _ := os.Hostname()
+	hash := sha1.Sum([]byte(local + p.Host + port + p.LoginName))
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", p.Host,
+		"%p", port,
+		"%r", p.LoginName,
+		"%n", originalHost,
+		"%C", hex.EncodeToString(hash[:]),
+	).Replace(path), nil
+}
+
+// parseControlPersist parses the ControlPersist option: "no" (or empty), the
+// control master exits when the last connection closes; "yes" (or 0), it
+// stays until it is asked to exit; else, a time in seconds or with units.
+func parseControlPersist(s string) (time.Duration, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "no":
+		return 0, nil
+	case "yes", "0":
+		return -1, nil
+	}
+	secs, err := parseConfigTime(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
@@ -0,0 +1,141 @@
+package params
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The types of port forwarding, like the -L, -R and -D options of ssh.
+const (
+	LocalForward   = "local"
+	RemoteForward  = "remote"
+	DynamicForward = "dynamic"
+)
+
+// Forward is a port forwarding. The connections are accepted on the listen
+// address, locally for the local and dynamic forwardings, and by the SSH
+// server for the remote ones. They are forwarded to the connect address,
+// except for the dynamic forwardings, that are SOCKS5 servers. The networks
+// are "tcp" or "unix". Spec is the forwarding as given on the command line.
+type Forward struct {
+	Type           string
+	Spec           string
+	ListenNetwork  string
+	ListenAddr     string
+	ConnectNetwork string
+	ConnectAddr    string
+}
+
+// ParseForward parses a port forwarding with the syntax of ssh:
+// [bind_address:]port:host:hostport, [bind_address:]port:socket,
+// socket:host:hostport or socket:socket for the local and remote
+// forwardings, and [bind_address:]port for the dynamic ones. The sockets are
+// paths that contain a slash, and the IPv6 addresses are given in brackets.
+// The connections are only accepted on the loopback interface when there is
+// no bind address, and on all the interfaces when it is "*".
+func ParseForward(typ, spec string) (Forward, error) {
+	f := Forward{Type: typ, Spec: spec, ListenNetwork: "tcp", ConnectNetwork: "tcp"}
+	fields := splitForward(spec)
+	// net.Listen takes an empty host for all the interfaces, but the SSH
+	// client sends the IP address of the remote forwardings
+	wildcard := ""
+	if typ == RemoteForward {
+		wildcard = "0.0.0.0"
+	}
+	var err error
+	if typ == DynamicForward {
+		switch len(fields) {
+		case 1:
+			f.ListenAddr, err = forwardAddr("", fields[0], wildcard)
+		case 2:
+			f.ListenAddr, err = forwardAddr(fields[0], fields[1], wildcard)
+		default:
+			err = fmt.Errorf("the format is [bind_address:]port")
+		}
+		if err != nil {
+			return f, fmt.Errorf("invalid dynamic forwarding %s: %s", spec, err)
+		}
+		return f, nil
+	}
+
+	if len(fields) < 2 || len(fields) > 4 {
+		return f, fmt.Errorf("invalid %s forwarding %s: the format is [bind_address:]port:host:hostport", typ, spec)
+	}
+	isSocket := func(s string) bool { return strings.Contains(s, "/") }
+	var listen, connect []string
+	switch {
+	case isSocket(fields[0]), isSocket(fields[1]):
+		listen, connect = fields[:1], fields[1:]
+	case len(fields) > 2 && isSocket(fields[2]):
+		listen, connect = fields[:2], fields[2:]
+	case len(fields) == 3:
+		listen, connect = fields[:1], fields[1:]
+	default:
+		listen, connect = fields[:2], fields[2:]
+	}
+	switch {
+	case len(listen) == 1 && isSocket(listen[0]):
+		f.ListenNetwork, f.ListenAddr = "unix", listen[0]
+	case len(listen) == 1:
+		f.ListenAddr, err = forwardAddr("", listen[0], wildcard)
+	default:
+		f.ListenAddr, err = forwardAddr(listen[0], listen[1], wildcard)
+	}
+	if err == nil {
+		switch {
+		case len(connect) == 1 && isSocket(connect[0]):
+			f.ConnectNetwork, f.ConnectAddr = "unix", connect[0]
+		case len(connect) == 2 && connect[0] != "":
+			f.ConnectAddr, err = forwardAddr(connect[0], connect[1], "")
+			if err == nil && strings.HasSuffix(f.ConnectAddr, ":0") {
+				err = fmt.Errorf("invalid port: %s", connect[1])
+			}
+		default:
+			err = fmt.Errorf("the format is [bind_address:]port:host:hostport")
+		}
+	}
+	if err != nil {
+		return f, fmt.Errorf("invalid %s forwarding %s: %s", typ, spec, err)
+	}
+	return f, nil
+}
+
+// splitForward splits a port forwarding on the colons, except between
+// brackets, and removes the brackets.
+func splitForward(spec string) []string {
+	var fields []string
+	var field strings.Builder
+	brackets := false
+	for _, r := range spec {
+		switch {
+		case r == '[' && !brackets:
+			brackets = true
+		case r == ']' && brackets:
+			brackets = false
+		case r == ':' && !brackets:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// forwardAddr returns the host:port address of a port forwarding. The "*"
+// host is replaced by wildcard.
+func forwardAddr(host, port, wildcard string) (string, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return "", fmt.Errorf("invalid port: %s", port)
+	}
+	switch host {
+	case "":
+		host = "127.0.0.1"
+	case "*":
+		host = wildcard
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p)), nil
+}
@@ -0,0 +1,111 @@
+package params
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		typ  string
+		spec string
+		want Forward
+	}{
+		{
+			typ:  LocalForward,
+			spec: "8080:localhost:80",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "127.0.0.1:8080", ConnectNetwork: "tcp", ConnectAddr: "localhost:80"},
+		},
+		{
+			typ:  LocalForward,
+			spec: "*:8080:db:5432",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: ":8080", ConnectNetwork: "tcp", ConnectAddr: "db:5432"},
+		},
+		{
+			typ:  RemoteForward,
+			spec: "*:8080:localhost:80",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "0.0.0.0:8080", ConnectNetwork: "tcp", ConnectAddr: "localhost:80"},
+		},
+		{
+			typ:  RemoteForward,
+			spec: "0:localhost:80",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "127.0.0.1:0", ConnectNetwork: "tcp", ConnectAddr: "localhost:80"},
+		},
+		{
+			typ:  LocalForward,
+			spec: "[::1]:8080:[fe80::1]:80",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "[::1]:8080", ConnectNetwork: "tcp", ConnectAddr: "[fe80::1]:80"},
+		},
+		{
+			typ:  LocalForward,
+			spec: "8080:/run/db.sock",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "127.0.0.1:8080", ConnectNetwork: "unix", ConnectAddr: "/run/db.sock"},
+		},
+		{
+			typ:  LocalForward,
+			spec: "10.0.0.1:8080:/run/db.sock",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "10.0.0.1:8080", ConnectNetwork: "unix", ConnectAddr: "/run/db.sock"},
+		},
+		{
+			typ:  RemoteForward,
+			spec: "/tmp/web.sock:localhost:80",
+			want: Forward{ListenNetwork: "unix", ListenAddr: "/tmp/web.sock", ConnectNetwork: "tcp", ConnectAddr: "localhost:80"},
+		},
+		{
+			typ:  LocalForward,
+			spec: "/tmp/local.sock:/run/remote.sock",
+			want: Forward{ListenNetwork: "unix", ListenAddr: "/tmp/local.sock", ConnectNetwork: "unix", ConnectAddr: "/run/remote.sock"},
+		},
+		{
+			typ:  DynamicForward,
+			spec: "1080",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "127.0.0.1:1080", ConnectNetwork: "tcp"},
+		},
+		{
+			typ:  DynamicForward,
+			spec: "*:1080",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: ":1080", ConnectNetwork: "tcp"},
+		},
+		{
+			typ:  DynamicForward,
+			spec: "[::1]:1080",
+			want: Forward{ListenNetwork: "tcp", ListenAddr: "[::1]:1080", ConnectNetwork: "tcp"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ+" "+tt.spec, func(t *testing.T) {
+			got, err := ParseForward(tt.typ, tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Type, tt.want.Spec = tt.typ, tt.spec
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseForwardErrors(t *testing.T) {
+	tests := []struct {
+		typ  string
+		spec string
+	}{
+		{DynamicForward, ""},
+		{DynamicForward, "socks"},
+		{DynamicForward, "localhost:1080:80"},
+		{LocalForward, "8080"},
+		{LocalForward, "web:http:localhost:80"},
+		{LocalForward, "8080:localhost:http"},
+		{LocalForward, "8080:localhost:0"},
+		{LocalForward, "8080::80"},
+		{LocalForward, "70000:localhost:80"},
+		{LocalForward, "-1:localhost:80"},
+		{RemoteForward, "a:1:b:2:c"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseForward(tt.typ, tt.spec); err == nil {
+			t.Errorf("%s forwarding %q was accepted", tt.typ, tt.spec)
+		}
+	}
+}
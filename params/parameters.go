@@ -1,18 +1,138 @@
 package params
 
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/awnumar/memguard"
+)
+
 type VaultParams struct {
-	Address    string
-	Token      string
-	AuthMethod string
-	AuthPath   string
-	Username   string
-	Password   string
-	SSHMount   string
-	SSHRole    string
+	Address       string
+	Token         string
+	AuthMethod    string
+	AuthPath      string
+	Username      string
+	Password      string
+	SSHMount      string
+	SSHRole       string
+	SSHHostMount  string
+	CACert        string
+	ClientCert    string
+	ClientKey     string
+	TLSSkipVerify bool
+	Namespace     string
+	Role          string
+	JWT           string
+	JWTFile       string
+	TokenHelper   string
+	OTPMount      string
+	OTPRole       string
 }
 
 type Params struct {
-	LogLevel string
-	Upcase   bool
-	Prefix   bool
+	LogLevel   string
+	Upcase     bool
+	Prefix     bool
+	SecretMode string
+}
+
+// How the Vault secrets are passed to the remote command.
+const (
+	// SecretModeEnv prefixes the remote command with env KEY=VALUE.
+	SecretModeEnv = "env"
+	// SecretModeSetenv sends the secrets as SSH environment requests.
+	SecretModeSetenv = "setenv"
+	// SecretModeStdin streams the secrets to a remote wrapper on stdin.
+	SecretModeStdin = "stdin"
+)
+
+// CheckSecretMode returns an error when mode is not a known secret mode.
+func CheckSecretMode(mode string) error {
+	switch mode {
+	case "", SecretModeEnv, SecretModeSetenv, SecretModeStdin:
+		return nil
+	default:
+		return fmt.Errorf("unknown secret mode: %s", mode)
+	}
+}
+
+// Secrets are the Vault secrets passed to the remote command.
+type Secrets struct {
+	Env   map[string]string
+	Mode  string
+	Files []SecretFile
+}
+
+// SecretFile is a Vault secret that is written to a remote file while the
+// remote command runs.
+type SecretFile struct {
+	Ref     string
+	Path    string
+	Mode    os.FileMode
+	Content *memguard.LockedBuffer
+}
+
+// ParseSecretFile parses a ref:path[:mode] specification, like
+// secret/db#pgpass:~/.pgpass:0600. The default mode is 0600.
+func ParseSecretFile(spec string) (SecretFile, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return SecretFile{}, fmt.Errorf("invalid secret file %s: the format is ref:path[:mode]", spec)
+	}
+	f := SecretFile{Ref: parts[0], Path: parts[1], Mode: 0600}
+	if len(parts) == 3 {
+		mode, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil || mode > 0777 {
+			return SecretFile{}, fmt.Errorf("invalid mode in secret file %s", spec)
+		}
+		f.Mode = os.FileMode(mode)
+	}
+	return f, nil
+}
+
+// Certificate extensions that can be requested from Vault.
+const (
+	PermitPTY             = "permit-pty"
+	PermitPortForwarding  = "permit-port-forwarding"
+	PermitAgentForwarding = "permit-agent-forwarding"
+	PermitX11Forwarding   = "permit-X11-forwarding"
+	PermitUserRC          = "permit-user-rc"
+)
+
+// SignParams describes the certificate that is requested from Vault.
+type SignParams struct {
+	TTL             string
+	KeyID           string
+	Principals      []string
+	Extensions      []string
+	CriticalOptions map[string]string
+	// defaulted is set when the extensions were not chosen by the user
+	defaulted bool
+}
+
+// DefaultExtensions adds the extensions to the requested ones, unless the user
+// has already chosen them explicitly. The defaults of the control master and
+// of the command are merged.
+func (p *SignParams) DefaultExtensions(extensions ...string) {
+	if len(p.Extensions) > 0 && !p.defaulted {
+		return
+	}
+	p.defaulted = true
+	for _, ext := range extensions {
+		if !containsString(p.Extensions, ext) {
+			p.Extensions = append(p.Extensions, ext)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
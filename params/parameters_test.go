@@ -0,0 +1,43 @@
+package params
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultExtensions(t *testing.T) {
+	tests := []struct {
+		name     string
+		explicit []string
+		defaults [][]string
+		want     []string
+	}{
+		{
+			name:     "command defaults",
+			defaults: [][]string{{PermitPTY}},
+			want:     []string{PermitPTY},
+		},
+		{
+			name:     "control master and command defaults are merged",
+			defaults: [][]string{{PermitPTY, PermitPortForwarding}, {PermitPTY, PermitAgentForwarding}},
+			want:     []string{PermitPTY, PermitPortForwarding, PermitAgentForwarding},
+		},
+		{
+			name:     "explicit extensions win",
+			explicit: []string{PermitX11Forwarding},
+			defaults: [][]string{{PermitPTY, PermitPortForwarding}, {PermitAgentForwarding}},
+			want:     []string{PermitX11Forwarding},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := SignParams{Extensions: tt.explicit}
+			for _, extensions := range tt.defaults {
+				p.DefaultExtensions(extensions...)
+			}
+			if !reflect.DeepEqual(p.Extensions, tt.want) {
+				t.Errorf("extensions = %v, want %v", p.Extensions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package params
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/go-homedir"
+)
+
+// DefaultConfigPath is the vssh configuration file, where the profiles are
+// defined.
+const DefaultConfigPath = "~/.config/vssh/config.hcl"
+
+// defaultProfile is the name of the profile that is used when no other
+// profile matches the host.
+const defaultProfile = "default"
+
+// Profile is a named set of options, defined in the vssh configuration file.
+// The options apply unless they are given on the command line or in the
+// environment.
+type Profile struct {
+	Name string `hcl:",key"`
+	// Hosts are the host patterns, with "*" and "?" wildcards, that select
+	// the profile automatically.
+	Hosts []string `hcl:"hosts"`
+
+	VaultAddress      string `hcl:"vault_address"`
+	VaultNamespace    string `hcl:"vault_namespace"`
+	VaultCACert       string `hcl:"vault_ca_cert"`
+	VaultClientCert   string `hcl:"vault_client_cert"`
+	VaultClientKey    string `hcl:"vault_client_key"`
+	VaultAuthMethod   string `hcl:"vault_auth_method"`
+	VaultAuthPath     string `hcl:"vault_auth_path"`
+	VaultAuthRole     string `hcl:"vault_auth_role"`
+	VaultUsername     string `hcl:"vault_username"`
+	VaultTokenHelper  string `hcl:"vault_token_helper"`
+	VaultSSHMount     string `hcl:"vault_ssh_mount"`
+	VaultSSHRole      string `hcl:"vault_ssh_role"`
+	VaultSSHHostMount string `hcl:"vault_ssh_host_mount"`
+	VaultOTPMount     string `hcl:"vault_otp_mount"`
+	VaultOTPRole      string `hcl:"vault_otp_role"`
+
+	Login          string   `hcl:"login"`
+	Port           int      `hcl:"port"`
+	PrivateKeys    []string `hcl:"private_keys"`
+	VPrivateKey    string   `hcl:"vault_private_key"`
+	HTTPProxy      string   `hcl:"http_proxy"`
+	Proxy          string   `hcl:"proxy"`
+	ProxyCommand   string   `hcl:"proxy_command"`
+	ControlPath    string   `hcl:"control_path"`
+	ControlPersist string   `hcl:"control_persist"`
+	Insecure       bool     `hcl:"insecure"`
+	KnownHosts     []string `hcl:"known_hosts"`
+
+	CertTTL           string   `hcl:"cert_ttl"`
+	CertKeyID         string   `hcl:"cert_key_id"`
+	CertPrincipals    []string `hcl:"cert_principals"`
+	CertExtensions    []string `hcl:"cert_extensions"`
+	CertForceCommand  string   `hcl:"cert_force_command"`
+	CertSourceAddress string   `hcl:"cert_source_address"`
+
+	CA *ProfileCA `hcl:"ca"`
+}
+
+// ProfileCA is the local CA of a profile, that signs the certificates instead
+// of Vault.
+type ProfileCA struct {
+	Key string `hcl:"key"`
+}
+
+// Config is the content of the vssh configuration file.
+type Config struct {
+	Profiles []Profile `hcl:"profile"`
+}
+
+// ReadConfig reads the vssh configuration file. A missing file is an empty
+// configuration.
+func ReadConfig(path string) (Config, error) {
+	var config Config
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return config, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = hcl.Decode(&config, string(content))
+	if err != nil {
+		return config, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// SelectProfile returns the profile with the given name or, when name is
+// empty, the first profile whose host patterns match host, and else the
+// "default" profile. It returns nil when no profile applies.
+func (c Config) SelectProfile(name, host string) (*Profile, error) {
+	if name != "" {
+		for i := range c.Profiles {
+			if c.Profiles[i].Name == name {
+				return &c.Profiles[i], nil
+			}
+		}
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if host != "" {
+		for i := range c.Profiles {
+			if matchPatterns(strings.ToLower(host), lowerAll(c.Profiles[i].Hosts)) {
+				return &c.Profiles[i], nil
+			}
+		}
+	}
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == defaultProfile {
+			return &c.Profiles[i], nil
+		}
+	}
+	return nil, nil
+}
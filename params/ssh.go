@@ -2,11 +2,23 @@ package params
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"net/url"
 	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"go.uber.org/zap"
 )
 
+// defaultServerAliveCountMax is the number of unanswered keepalives after
+// which the connection is closed, when ServerAliveCountMax is not set.
+const defaultServerAliveCountMax = 3
+
 type SSHParams struct {
 	Port      int
 	Insecure  bool
@@ -15,9 +27,54 @@ type SSHParams struct {
 	Commands  []string
 	HTTPProxy *url.URL
 	UseAgent  bool
+	Sign      SignParams
+	HostCA    string
+	// Proxy is a SOCKS5 proxy, and ProxyCommand a command whose stdin and
+	// stdout are the connection. They are used instead of HTTPProxy.
+	Proxy        *url.URL
+	ProxyCommand string
+	// ControlPath is the unix socket of the control master, that shares its
+	// connection. ControlPersist is how long the control master stays after
+	// the last connection closes: forever when it is negative.
+	ControlPath    string
+	ControlPersist time.Duration
+	// Subsystem runs the command as a subsystem, like sftp. NoTerminal
+	// disables the pseudo-terminal, even without a command. ForwardAgent
+	// forwards the local SSH agent to the session.
+	Subsystem    bool
+	NoTerminal   bool
+	ForwardAgent bool
+	// Forwards are the port forwardings that run on the connection of the
+	// session. NoSession only runs them, without a session, like ssh -N.
+	Forwards  []Forward
+	NoSession bool
+	// OriginalHost is the host as given on the command line, before it is
+	// resolved through ssh_config.
+	OriginalHost string
+	// IdentityFiles are the private keys from ssh_config, used when no
+	// private key is given on the command line.
+	IdentityFiles []string
+	// SSHConfigFiles are the ssh_config files the host was resolved with.
+	SSHConfigFiles []string
+	// Jumps are the jump hosts, in the order they are connected to.
+	Jumps []Jump
+	// KnownHostsFiles replace ~/.ssh/known_hosts when they are not nil.
+	KnownHostsFiles     []string
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
 }
 
-func GetSSHParams(c CLIContext) (p SSHParams, err error) {
+// Jump is a jump host, with its own options: its certificate may be signed
+// with another Vault role than the one of the destination.
+type Jump struct {
+	Context CLIContext
+	SSH     SSHParams
+}
+
+// GetSSHParams returns the SSH parameters for the host given on the command
+// line. The host is resolved through the ssh_config files, and the command
+// line flags take precedence over them.
+func GetSSHParams(c CLIContext, l *zap.SugaredLogger) (p SSHParams, err error) {
 	p.Host = strings.TrimSpace(c.SSHHost())
 	if p.Host == "" {
 		return p, errors.New("empty host")
@@ -27,22 +84,231 @@ func GetSSHParams(c CLIContext) (p SSHParams, err error) {
 		p.LoginName = spl[0]
 		p.Host = spl[1]
 	}
+	p.OriginalHost = p.Host
 	if p.LoginName == "" {
 		p.LoginName = c.SSHLogin()
-		if p.LoginName == "" {
-			u, err := user.Current()
-			if err != nil {
-				return p, err
-			}
-			p.LoginName = u.Username
+	}
+	var files []string
+	switch f := strings.TrimSpace(c.SSHConfigFile()); f {
+	case "":
+		files = SSHConfigFiles
+	case "none":
+	default:
+		files = []string{f}
+	}
+	var hostConfig SSHHostConfig
+	if options := c.SSHOptions(); len(files) > 0 || len(options) > 0 {
+		hostConfig, err = resolveSSHConfig(p.Host, p.LoginName, options, files, l)
+		if err != nil {
+			return p, fmt.Errorf("failed to read ssh_config: %s", err)
 		}
+		p.Host = hostConfig.HostName
+		p.LoginName = hostConfig.User
+	}
+	if p.LoginName == "" {
+		u, err := user.Current()
+		if err != nil {
+			return p, err
+		}
+		p.LoginName = u.Username
 	}
 	p.Commands = c.SSHCommand()
 	p.Insecure = c.SSHInsecure()
 	p.UseAgent = c.SSHAgent()
 	p.Port = c.SSHPort()
+	if p.Port == 0 {
+		p.Port = hostConfig.Port
+	}
+	if p.Port == 0 {
+		p.Port = 22
+	}
+	p.IdentityFiles = hostConfig.IdentityFiles
+	p.SSHConfigFiles = files
+	jumps := strings.TrimSpace(c.SSHJump())
+	if jumps == "" {
+		jumps = hostConfig.ProxyJump
+	}
+	if jumps != "" && jumps != "none" {
+		p.Jumps, err = getJumps(c, jumps, l)
+		if err != nil {
+			return p, err
+		}
+	}
+	p.KnownHostsFiles = hostConfig.UserKnownHostsFiles
+	if files := c.KnownHostsFiles(); len(files) > 0 {
+		p.KnownHostsFiles = make([]string, 0, len(files))
+		for _, f := range files {
+			f, err := homedir.Expand(f)
+			if err != nil {
+				return p, err
+			}
+			p.KnownHostsFiles = append(p.KnownHostsFiles, f)
+		}
+	}
+	p.ServerAliveInterval = time.Duration(hostConfig.ServerAliveInterval) * time.Second
+	p.ServerAliveCountMax = hostConfig.ServerAliveCountMax
+	if p.ServerAliveCountMax == 0 {
+		p.ServerAliveCountMax = defaultServerAliveCountMax
+	}
+	p.Sign, err = GetSignParams(c)
+	if err != nil {
+		return p, err
+	}
+	if mount := strings.Trim(c.VaultSSHHostMount(), "/"); mount != "" {
+		p.HostCA, err = HostCACachePath(c.VaultAddress(), mount)
+		if err != nil {
+			return p, err
+		}
+	}
 	if c.HTTPProxy() != "" {
 		p.HTTPProxy, err = url.Parse(c.HTTPProxy())
+		if err != nil {
+			return p, err
+		}
+	}
+	if c.Proxy() != "" {
+		p.Proxy, err = parseProxy(c.Proxy())
+		if err != nil {
+			return p, err
+		}
+	}
+	p.ProxyCommand = strings.TrimSpace(c.ProxyCommand())
+	if path := strings.TrimSpace(c.ControlPath()); path != "" && path != "none" {
+		p.ControlPath, err = expandControlPath(path, c.SSHHost(), p)
+		if err != nil {
+			return p, err
+		}
+		p.ControlPersist, err = parseControlPersist(c.ControlPersist())
+		if err != nil {
+			return p, err
+		}
+		// the connection of the control master is shared by all the commands
+		p.Sign.DefaultExtensions(PermitPTY, PermitPortForwarding)
+	}
+	return p, nil
+}
+
+// parseProxy parses the URL of a SOCKS5 proxy. With socks5://, the host names
+// are resolved locally, and with socks5h:// by the proxy.
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %s (socks5 or socks5h expected)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in proxy URL: %s", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	return u, nil
+}
+
+// getJumps resolves the jump hosts of a ProxyJump specification:
+// [user@]host[:port] or ssh://[user@]host[:port], separated by commas.
+func getJumps(c CLIContext, spec string, l *zap.SugaredLogger) ([]Jump, error) {
+	var jumps []Jump
+	for _, hop := range strings.Split(spec, ",") {
+		host, port, err := ParseJumpHost(hop)
+		if err != nil {
+			return nil, err
+		}
+		hopContext := c.ForJumpHost(host, port)
+		hopParams, err := GetSSHParams(hopContext, l)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %s", host, err)
+		}
+		jumps = append(jumps, Jump{Context: hopContext, SSH: hopParams})
+	}
+	return jumps, nil
+}
+
+// ParseJumpHost parses a jump host, as [user@]host[:port] or
+// ssh://[user@]host[:port]. The returned host keeps the user part. The port
+// is 0 when it is not given.
+func ParseJumpHost(s string) (host string, port int, err error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "ssh://")
+	if s == "" {
+		return "", 0, errors.New("empty jump host")
+	}
+	var login string
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		login, s = s[:i+1], s[i+1:]
+	}
+	host = s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return "", 0, fmt.Errorf("invalid jump host port: %s", p)
+		}
+		host = h
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1]
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("invalid jump host: %s", s)
+	}
+	return login + host, port, nil
+}
+
+// HostCACachePath returns the path where the public key of the Vault host
+// signer is cached.
+func HostCACachePath(vaultAddress, mount string) (string, error) {
+	dir, err := homedir.Expand("~/.cache/vssh/hostca")
+	if err != nil {
+		return "", err
+	}
+	server := vaultAddress
+	if u, err := url.Parse(vaultAddress); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(server + "_" + mount)
+	return filepath.Join(dir, name+".pub"), nil
+}
+
+func GetSignParams(c CLIContext) (p SignParams, err error) {
+	p.TTL = strings.TrimSpace(c.CertTTL())
+	p.KeyID = strings.TrimSpace(c.CertKeyID())
+	for _, principal := range c.CertPrincipals() {
+		for _, s := range strings.Split(principal, ",") {
+			s = strings.TrimSpace(s)
+			if s != "" {
+				p.Principals = append(p.Principals, s)
+			}
+		}
+	}
+	for _, ext := range c.CertExtensions() {
+		for _, s := range strings.Split(ext, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if !knownExtension(s) {
+				return p, fmt.Errorf("unknown certificate extension: %s", s)
+			}
+			p.Extensions = append(p.Extensions, s)
+		}
+	}
+	if cmd := strings.TrimSpace(c.CertForceCommand()); cmd != "" {
+		p.CriticalOptions = map[string]string{"force-command": cmd}
+	}
+	if addr := strings.TrimSpace(c.CertSourceAddress()); addr != "" {
+		if p.CriticalOptions == nil {
+			p.CriticalOptions = make(map[string]string)
+		}
+		p.CriticalOptions["source-address"] = addr
+	}
+	return p, nil
+}
+
+func knownExtension(ext string) bool {
+	switch ext {
+	case PermitPTY, PermitPortForwarding, PermitAgentForwarding, PermitX11Forwarding, PermitUserRC:
+		return true
+	default:
+		return false
 	}
-	return p, err
 }
@@ -0,0 +1,487 @@
+package params
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mitchellh/go-homedir"
+	"go.uber.org/zap"
+)
+
+// SSHConfigFiles are the ssh_config files that are read, in order, when no
+// file is given explicitly.
+var SSHConfigFiles = []string{"~/.ssh/config", "/etc/ssh/ssh_config"}
+
+// maxIncludeDepth limits the recursion of the Include directives, like
+// OpenSSH does.
+const maxIncludeDepth = 16
+
+// SSHHostConfig holds the ssh_config options that apply to a host. As with
+// OpenSSH, the first value obtained for an option is used, except for the
+// options that accumulate.
+type SSHHostConfig struct {
+	HostName            string
+	User                string
+	Port                int
+	IdentityFiles       []string
+	ProxyJump           string
+	ServerAliveInterval int
+	ServerAliveCountMax int
+	UserKnownHostsFiles []string
+}
+
+type sshConfigResolver struct {
+	host      string
+	localUser string
+	config    SSHHostConfig
+	seen      map[string]bool
+	l         *zap.SugaredLogger
+}
+
+// ResolveSSHConfig returns the options of the ssh_config files that apply to
+// host. user is the remote user given on the command line, if any. The Host
+// and Match blocks, the wildcards and the Include directives are supported.
+// The files that do not exist are skipped.
+func ResolveSSHConfig(host, user string, l *zap.SugaredLogger, files ...string) (SSHHostConfig, error) {
+	if len(files) == 0 {
+		files = SSHConfigFiles
+	}
+	return resolveSSHConfig(host, user, nil, files, l)
+}
+
+// resolveSSHConfig is like ResolveSSHConfig, but the options, given as
+// "Keyword value" or "Keyword=value" like the -o options of OpenSSH, come
+// before the ssh_config files.
+func resolveSSHConfig(host, user string, options, files []string, l *zap.SugaredLogger) (SSHHostConfig, error) {
+	r := &sshConfigResolver{host: host, seen: make(map[string]bool), l: l}
+	r.localUser = currentUser()
+	r.config.User = user
+	for _, option := range options {
+		keyword, args, err := splitConfigLine(option)
+		if err == nil {
+			switch keyword {
+			case "", "host", "match", "include":
+				err = errors.New("not an option")
+			default:
+				err = r.set(keyword, args)
+			}
+		}
+		if err != nil {
+			return SSHHostConfig{}, fmt.Errorf("invalid option %q: %s", option, err)
+		}
+	}
+	for _, f := range files {
+		path, err := homedir.Expand(f)
+		if err != nil {
+			return SSHHostConfig{}, err
+		}
+		err = r.readFile(path, filepath.Dir(path), 0)
+		if err != nil && !os.IsNotExist(err) {
+			return SSHHostConfig{}, err
+		}
+	}
+	c := r.config
+	if c.HostName == "" {
+		c.HostName = host
+	}
+	c.HostName = r.expand(c.HostName, nil)
+	for i, f := range c.IdentityFiles {
+		c.IdentityFiles[i] = r.expand(f, &c)
+	}
+	for i, f := range c.UserKnownHostsFiles {
+		c.UserKnownHostsFiles[i] = r.expand(f, &c)
+	}
+	return c, nil
+}
+
+func (r *sshConfigResolver) readFile(path, includeDir string, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	active := true
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		keyword, args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s line %d: %s", path, lineno, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "host":
+			active = matchPatterns(strings.ToLower(r.host), lowerAll(args))
+		case "match":
+			active, err = r.match(args)
+		case "include":
+			if !active {
+				continue
+			}
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("%s line %d: too many nested includes", path, lineno)
+			}
+			err = r.include(args, includeDir, depth)
+		default:
+			if active {
+				err = r.set(keyword, args)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s line %d: %s", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (r *sshConfigResolver) include(args []string, includeDir string, depth int) error {
+	for _, arg := range args {
+		pattern, err := homedir.Expand(arg)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(includeDir, pattern)
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			err := r.readFile(path, includeDir, depth+1)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// match evaluates the criteria of a Match block. Match exec is never
+// evaluated, and the criteria that vssh does not know, like address or
+// localport, are not either: the blocks that depend on them do not apply,
+// whether the criterion is negated or not.
+func (r *sshConfigResolver) match(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, errors.New("Match needs criteria")
+	}
+	result := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+		var matched bool
+		switch criterion {
+		case "all", "final":
+			matched = true
+		case "canonical":
+			matched = false
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf("Match %s needs an argument", criterion)
+			}
+			i++
+			patterns := strings.Split(args[i], ",")
+			switch criterion {
+			case "host":
+				hostname := r.config.HostName
+				if hostname == "" {
+					hostname = r.host
+				}
+				matched = matchPatterns(strings.ToLower(r.expand(hostname, nil)), lowerAll(patterns))
+			case "originalhost":
+				matched = matchPatterns(strings.ToLower(r.host), lowerAll(patterns))
+			case "user":
+				matched = matchPatterns(r.remoteUser(), patterns)
+			case "localuser":
+				matched = matchPatterns(r.localUser, patterns)
+			case "exec":
+				result = false
+				continue
+			}
+		default:
+			// like exec, the other criteria take an argument
+			r.l.Warnw("unsupported Match criterion in ssh_config: the Match block is ignored", "criterion", criterion)
+			i++
+			result = false
+			continue
+		}
+		if matched == negate {
+			result = false
+		}
+	}
+	return result, nil
+}
+
+func (r *sshConfigResolver) set(keyword string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s needs a value", keyword)
+	}
+	c := &r.config
+	switch keyword {
+	case "hostname":
+		if c.HostName == "" {
+			c.HostName = args[0]
+		}
+	case "user":
+		if c.User == "" {
+			c.User = args[0]
+		}
+	case "port":
+		if c.Port == 0 {
+			port, err := strconv.Atoi(args[0])
+			if err != nil || port <= 0 || port > 65535 {
+				return fmt.Errorf("invalid port: %s", args[0])
+			}
+			c.Port = port
+		}
+	case "identityfile":
+		// IdentityFile accumulates, but the same file is only used once
+		if !r.seen[args[0]] {
+			r.seen[args[0]] = true
+			c.IdentityFiles = append(c.IdentityFiles, args[0])
+		}
+	case "proxyjump":
+		// "none" is kept, so that it overrides the next ProxyJump options
+		if c.ProxyJump == "" {
+			c.ProxyJump = args[0]
+		}
+	case "serveraliveinterval":
+		if c.ServerAliveInterval == 0 {
+			secs, err := parseConfigTime(args[0])
+			if err != nil {
+				return err
+			}
+			c.ServerAliveInterval = secs
+		}
+	case "serveralivecountmax":
+		if c.ServerAliveCountMax == 0 {
+			count, err := strconv.Atoi(args[0])
+			if err != nil || count <= 0 {
+				return fmt.Errorf("invalid ServerAliveCountMax: %s", args[0])
+			}
+			c.ServerAliveCountMax = count
+		}
+	case "userknownhostsfile":
+		if c.UserKnownHostsFiles == nil {
+			c.UserKnownHostsFiles = []string{}
+			if !strings.EqualFold(args[0], "none") {
+				c.UserKnownHostsFiles = args
+			}
+		}
+	}
+	return nil
+}
+
+func (r *sshConfigResolver) remoteUser() string {
+	if r.config.User != "" {
+		return r.config.User
+	}
+	return r.localUser
+}
+
+// expand replaces the ssh_config tokens in s. The tokens that depend on the
+// final configuration (%p and %r) are only replaced when c is given.
+func (r *sshConfigResolver) expand(s string, c *SSHHostConfig) string {
+	if !strings.ContainsAny(s, "%~") {
+		return s
+	}
+	if p, err := homedir.Expand(s); err == nil {
+		s = p
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'n':
+			b.WriteString(r.host)
+		case 'h':
+			if c != nil {
+				b.WriteString(c.HostName)
+			} else {
+				b.WriteString(r.host)
+			}
+		case 'u':
+			b.WriteString(r.localUser)
+		case 'd':
+			home, _ := homedir.Dir()
+			b.WriteString(home)
+		case 'r':
+			if c == nil {
+				b.WriteString("%r")
+				continue
+			}
+			b.WriteString(r.remoteUser())
+		case 'p':
+			if c == nil {
+				b.WriteString("%p")
+				continue
+			}
+			port := c.Port
+			if port == 0 {
+				port = 22
+			}
+			b.WriteString(strconv.Itoa(port))
+		default:
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// splitConfigLine returns the lower-cased keyword of a ssh_config line and its
+// arguments. The keyword may be separated from the arguments by "=", and the
+// arguments may be double-quoted.
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexFunc(line, func(r rune) bool { return unicode.IsSpace(r) || r == '=' })
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeftFunc(line[end:], unicode.IsSpace)
+	rest = strings.TrimPrefix(rest, "=")
+	var args []string
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" || rest[0] == '#' {
+			break
+		}
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, errors.New("unterminated quote")
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+	return keyword, args, nil
+}
+
+// matchPatterns tells whether s matches a list of patterns: at least one
+// pattern matches, and no negated pattern does.
+func matchPatterns(s string, patterns []string) bool {
+	var matched bool
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchPattern(p[1:], s) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(p, s) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+func lowerAll(patterns []string) []string {
+	lower := make([]string, len(patterns))
+	for i, p := range patterns {
+		lower[i] = strings.ToLower(p)
+	}
+	return lower
+}
+
+// matchPattern matches s against a pattern where "*" matches any sequence of
+// characters, and "?" any single character.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return s == ""
+}
+
+// parseConfigTime parses a ssh_config time interval, in seconds or with
+// units (ex: 1m30s), and returns it in seconds.
+func parseConfigTime(s string) (int, error) {
+	var total, n int
+	var digits bool
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n = n*10 + int(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("invalid time interval: %s", s)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			n *= 60
+		case 'h':
+			n *= 3600
+		case 'd':
+			n *= 86400
+		case 'w':
+			n *= 604800
+		default:
+			return 0, fmt.Errorf("invalid time interval: %s", s)
+		}
+		total += n
+		n, digits = 0, false
+	}
+	return total + n, nil
+}
+
+func currentUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
@@ -0,0 +1,319 @@
+package params
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestResolveSSHConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		includes map[string]string
+		host     string
+		user     string
+		options  []string
+		want     SSHHostConfig
+	}{
+		{
+			name: "no matching block",
+			config: `
+Host other
+    HostName other.example.org
+    Port 2200
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "server"},
+		},
+		{
+			name: "first value wins",
+			config: `
+Host server
+    HostName first.example.org
+    Port 2201
+    User alice
+Host *
+    HostName second.example.org
+    Port 2202
+    User bob
+    ServerAliveInterval 1m30s
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "first.example.org", Port: 2201, User: "alice", ServerAliveInterval: 90},
+		},
+		{
+			name: "options before Host",
+			config: `
+Port 2200
+Host server
+    Port 2201
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "server", Port: 2200},
+		},
+		{
+			name: "wildcards",
+			config: `
+Host web-?? *.example.org
+    User deploy
+`,
+			host: "web-01",
+			want: SSHHostConfig{HostName: "web-01", User: "deploy"},
+		},
+		{
+			name: "negated pattern",
+			config: `
+Host *.example.org !bastion.example.org
+    ProxyJump bastion.example.org
+Host *
+    ProxyJump none
+`,
+			host: "bastion.example.org",
+			want: SSHHostConfig{HostName: "bastion.example.org", ProxyJump: "none"},
+		},
+		{
+			name: "host patterns are case insensitive",
+			config: `
+Host SERVER
+    Port 2200
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "server", Port: 2200},
+		},
+		{
+			name: "Match host uses the HostName",
+			config: `
+Host alias
+    HostName real.example.org
+Match host real.example.org
+    Port 2200
+Match originalhost real.example.org
+    User nobody
+`,
+			host: "alias",
+			want: SSHHostConfig{HostName: "real.example.org", Port: 2200},
+		},
+		{
+			name: "Match user",
+			config: `
+Match user root
+    Port 2200
+Match user alice,bob
+    Port 2201
+`,
+			host: "server",
+			user: "bob",
+			want: SSHHostConfig{HostName: "server", User: "bob", Port: 2201},
+		},
+		{
+			name: "Match with several criteria",
+			config: `
+Match originalhost server user alice
+    Port 2200
+Match originalhost server !user alice
+    Port 2201
+`,
+			host: "server",
+			user: "alice",
+			want: SSHHostConfig{HostName: "server", User: "alice", Port: 2200},
+		},
+		{
+			name: "Match all",
+			config: `
+Host other
+    Port 2200
+Match all
+    Port 2201
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "server", Port: 2201},
+		},
+		{
+			name: "Match exec does not apply",
+			config: `
+Match exec "true"
+    Port 2200
+Match !exec "false"
+    Port 2201
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "server"},
+		},
+		{
+			name: "unsupported Match criteria do not apply",
+			config: `
+Match address 10.0.0.0/8
+    Port 2200
+Match originalhost server !localport 22
+    Port 2201
+Match tagged prod
+    User admin
+Host server
+    Port 2202
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "server", Port: 2202},
+		},
+		{
+			name: "Include",
+			config: `
+Include conf.d/*.conf
+Host *
+    Port 2202
+`,
+			includes: map[string]string{
+				"conf.d/a.conf": "Host server\n    Port 2200\n",
+				"conf.d/b.conf": "Host server\n    Port 2201\n    User alice\n",
+			},
+			host: "server",
+			want: SSHHostConfig{HostName: "server", Port: 2200, User: "alice"},
+		},
+		{
+			name: "Include in a block that does not apply",
+			config: `
+Host other
+    Include other.conf
+`,
+			includes: map[string]string{"other.conf": "Port 2200\n"},
+			host:     "server",
+			want:     SSHHostConfig{HostName: "server"},
+		},
+		{
+			name: "identity files accumulate",
+			config: `
+Host server
+    IdentityFile /keys/server
+Host *
+    IdentityFile /keys/%r@%h:%p
+    IdentityFile /keys/server
+`,
+			host: "server",
+			user: "alice",
+			want: SSHHostConfig{HostName: "server", User: "alice", IdentityFiles: []string{"/keys/server", "/keys/alice@server:22"}},
+		},
+		{
+			name: "UserKnownHostsFile none",
+			config: `
+Host server
+    UserKnownHostsFile none
+Host *
+    UserKnownHostsFile /etc/ssh/known_hosts
+`,
+			host: "server",
+			want: SSHHostConfig{HostName: "server", UserKnownHostsFiles: []string{}},
+		},
+		{
+			name: "command line options take precedence",
+			config: `
+Host server
+    Port 2200
+    User alice
+    HostName real.example.org
+`,
+			host:    "server",
+			options: []string{"Port=2201", "User bob"},
+			want:    SSHHostConfig{HostName: "real.example.org", Port: 2201, User: "bob"},
+		},
+		{
+			name: "user of the command line takes precedence",
+			config: `
+Host server
+    User alice
+`,
+			host:    "server",
+			user:    "carol",
+			options: []string{"User bob"},
+			want:    SSHHostConfig{HostName: "server", User: "carol"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "vssh-sshconfig")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+			files := map[string]string{"config": tt.config}
+			for name, content := range tt.includes {
+				files[name] = content
+			}
+			for name, content := range files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := resolveSSHConfig(tt.host, tt.user, tt.options, []string{filepath.Join(dir, "config")}, zap.NewNop().Sugar())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSSHConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		options []string
+	}{
+		{name: "invalid port", config: "Port http\n"},
+		{name: "Match without criteria", config: "Match\n"},
+		{name: "Match without argument", config: "Match host\n"},
+		{name: "unterminated quote", config: "IdentityFile \"/keys/id\n"},
+		{name: "Host as an option", options: []string{"Host server"}},
+		{name: "option without value", options: []string{"Port"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "vssh-sshconfig")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+			path := filepath.Join(dir, "config")
+			if err := ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err = resolveSSHConfig("server", "", tt.options, []string{path}, zap.NewNop().Sugar())
+			if err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		s        string
+		patterns []string
+		want     bool
+	}{
+		{"server", []string{"server"}, true},
+		{"server", []string{"serv*"}, true},
+		{"server", []string{"serve?"}, true},
+		{"server", []string{"serve"}, false},
+		{"server", []string{"*"}, true},
+		{"server", []string{"*", "!server"}, false},
+		{"other", []string{"*", "!server"}, true},
+		{"server", []string{"!server"}, false},
+		{"a.example.org", []string{"*.example.org"}, true},
+		{"example.org", []string{"*.example.org"}, false},
+	}
+	for _, tt := range tests {
+		if got := matchPatterns(tt.s, tt.patterns); got != tt.want {
+			t.Errorf("matchPatterns(%q, %v) = %v, want %v", tt.s, tt.patterns, got, tt.want)
+		}
+	}
+}
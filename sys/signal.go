@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -16,3 +17,38 @@ func CancelOnSignal(cancel context.CancelFunc) {
 		}
 	}()
 }
+
+type releaseSignalsKey struct{}
+
+// SignalContext returns a context that is canceled on SIGINT and SIGTERM,
+// like CancelOnSignal, until ReleaseSignals is called with it.
+func SignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			signal.Stop(sigchan)
+			close(sigchan)
+		})
+	}
+	go func() {
+		for range sigchan {
+			cancel()
+		}
+	}()
+	return context.WithValue(ctx, releaseSignalsKey{}, release), func() {
+		release()
+		cancel()
+	}
+}
+
+// ReleaseSignals stops canceling a context returned by SignalContext on
+// SIGINT and SIGTERM, when they are handled otherwise. The other handler must
+// be registered with signal.Notify before, so that the signals are not lost.
+func ReleaseSignals(ctx context.Context) {
+	if release, ok := ctx.Value(releaseSignalsKey{}).(func()); ok {
+		release()
+	}
+}
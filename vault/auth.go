@@ -0,0 +1,212 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/mitchellh/go-homedir"
+	vexec "github.com/stephane-martin/vault-exec/lib"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+)
+
+// NewClient returns a Vault client that is configured with the address, TLS
+// and namespace parameters. The client is not authenticated yet.
+func NewClient(vaultParams params.VaultParams) (*api.Client, error) {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, fmt.Errorf("error configuring vault client: %s", config.Error)
+	}
+	config.Address = vaultParams.Address
+	err := config.ConfigureTLS(&api.TLSConfig{
+		CACert:     vaultParams.CACert,
+		ClientCert: vaultParams.ClientCert,
+		ClientKey:  vaultParams.ClientKey,
+		Insecure:   vaultParams.TLSSkipVerify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error configuring vault TLS: %s", err)
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault client: %s", err)
+	}
+	if vaultParams.Namespace != "" {
+		client.SetNamespace(vaultParams.Namespace)
+	}
+	return client, nil
+}
+
+// Auth authenticates the client to Vault with the configured method.
+func Auth(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error {
+	method, ok := LookupAuthMethod(vaultParams.AuthMethod)
+	if !ok {
+		return fmt.Errorf("unknown auth type: %s", vaultParams.AuthMethod)
+	}
+	return method.Login(ctx, client, vaultParams, l)
+}
+
+func tokenLogin(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error {
+	l.Debug("token based authentication")
+	tok := vaultParams.Token
+	if tok == "" {
+		t, err := vexec.Input("enter token: ", true)
+		if err != nil {
+			return fmt.Errorf("error reading token: %s", err)
+		}
+		tok = string(t)
+	}
+	if tok == "" {
+		return errors.New("empty token")
+	}
+	client.SetToken(tok)
+	return nil
+}
+
+func userpassLogin(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error {
+	username, password, err := credentials(vaultParams, "username", "password")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("auth/%s/login/%s", vaultParams.AuthPath, username)
+	return login(ctx, client, path, map[string]interface{}{"password": password})
+}
+
+func approleLogin(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error {
+	roleID, secretID, err := credentials(vaultParams, "RoleID", "SecretID")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("auth/%s/login", vaultParams.AuthPath)
+	return login(ctx, client, path, map[string]interface{}{"role_id": roleID, "secret_id": secretID})
+}
+
+func jwtLogin(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error {
+	jwt, err := readJWT(vaultParams, "")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("auth/%s/login", vaultParams.AuthPath)
+	return login(ctx, client, path, map[string]interface{}{"role": vaultParams.Role, "jwt": jwt})
+}
+
+func kubernetesLogin(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error {
+	if vaultParams.Role == "" {
+		return errors.New("kubernetes auth needs a role")
+	}
+	jwt, err := readJWT(vaultParams, kubernetesTokenPath)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("auth/%s/login", vaultParams.AuthPath)
+	return login(ctx, client, path, map[string]interface{}{"role": vaultParams.Role, "jwt": jwt})
+}
+
+func certLogin(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error {
+	if vaultParams.ClientCert == "" {
+		return errors.New("cert auth needs a client certificate")
+	}
+	options := map[string]interface{}{}
+	if vaultParams.Role != "" {
+		options["name"] = vaultParams.Role
+	}
+	path := fmt.Sprintf("auth/%s/login", vaultParams.AuthPath)
+	return login(ctx, client, path, options)
+}
+
+const kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// readJWT returns the JWT given on the command line, or read from the JWT
+// file. defaultPath is used when neither is set.
+func readJWT(vaultParams params.VaultParams, defaultPath string) (string, error) {
+	if vaultParams.JWT != "" {
+		return vaultParams.JWT, nil
+	}
+	path := vaultParams.JWTFile
+	if path == "" {
+		path = defaultPath
+	}
+	if path == "" {
+		return "", errors.New("no JWT was provided")
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading JWT: %s", err)
+	}
+	jwt := strings.TrimSpace(string(content))
+	if jwt == "" {
+		return "", fmt.Errorf("empty JWT in %s", path)
+	}
+	return jwt, nil
+}
+
+// credentials returns the username and password parameters, and asks the
+// user for them when they are empty.
+func credentials(vaultParams params.VaultParams, userLabel, passLabel string) (string, string, error) {
+	username := vaultParams.Username
+	if username == "" {
+		u, err := vexec.Input(fmt.Sprintf("enter %s: ", userLabel), false)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading %s: %s", userLabel, err)
+		}
+		if len(u) == 0 {
+			return "", "", fmt.Errorf("empty %s", userLabel)
+		}
+		username = string(u)
+	}
+	password := vaultParams.Password
+	if password == "" {
+		p, err := vexec.Input(fmt.Sprintf("enter %s: ", passLabel), true)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading %s: %s", passLabel, err)
+		}
+		if len(p) == 0 {
+			return "", "", fmt.Errorf("empty %s", passLabel)
+		}
+		password = string(p)
+	}
+	return username, password, nil
+}
+
+// loginResult is the outcome of a login request.
+type loginResult struct {
+	token string
+	err   error
+}
+
+// login writes the options to the login path of an auth method, and sets the
+// client token from the response. When ctx is canceled, the client is left
+// untouched.
+func login(ctx context.Context, client *api.Client, path string, options map[string]interface{}) error {
+	c := make(chan loginResult, 1)
+	go func() {
+		secret, err := client.Logical().Write(path, options)
+		if err != nil {
+			c <- loginResult{err: fmt.Errorf("vault auth error: %s", err)}
+			return
+		}
+		if secret == nil || secret.Auth == nil {
+			c <- loginResult{err: errors.New("vault auth error: no token in response")}
+			return
+		}
+		c <- loginResult{token: secret.Auth.ClientToken}
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-c:
+		if res.err != nil {
+			return res.err
+		}
+		client.SetToken(res.token)
+		return nil
+	}
+}
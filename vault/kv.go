@@ -0,0 +1,151 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"go.uber.org/zap"
+)
+
+// SecretRef references a secret in Vault, written as path#field@version.
+// The field and the version are optional. The version is only meaningful for
+// KV version 2 secret engines.
+type SecretRef struct {
+	Path    string
+	Field   string
+	Version int
+}
+
+func (r SecretRef) String() string {
+	s := r.Path
+	if r.Field != "" {
+		s += "#" + r.Field
+	}
+	if r.Version != 0 {
+		s += "@" + strconv.Itoa(r.Version)
+	}
+	return s
+}
+
+// ParseSecretRef parses a path#field@version reference.
+func ParseSecretRef(s string) (SecretRef, error) {
+	var ref SecretRef
+	if i := strings.LastIndex(s, "@"); i != -1 {
+		// a suffix that is not a number belongs to the path or the field
+		if version, err := strconv.Atoi(s[i+1:]); err == nil {
+			if version <= 0 {
+				return ref, fmt.Errorf("invalid secret version in %s", s)
+			}
+			ref.Version = version
+			s = s[:i]
+		}
+	}
+	if i := strings.LastIndex(s, "#"); i != -1 {
+		ref.Field = s[i+1:]
+		if ref.Field == "" {
+			return ref, fmt.Errorf("empty secret field in %s", s)
+		}
+		s = s[:i]
+	}
+	ref.Path = strings.Trim(s, "/")
+	if ref.Path == "" {
+		return ref, errors.New("empty secret path")
+	}
+	return ref, nil
+}
+
+// kvMount describes the secret engine mount that a path belongs to.
+type kvMount struct {
+	path    string
+	version int
+}
+
+// lookupMount asks Vault which mount a secret path belongs to, and the KV
+// version of that mount. When the lookup is not permitted, the path is
+// assumed to be a KV version 1 secret.
+func lookupMount(ctx context.Context, client *api.Client, path string, l *zap.SugaredLogger) kvMount {
+	r := client.NewRequest("GET", "/v1/sys/internal/ui/mounts/"+path)
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil {
+		l.Debugw("mount lookup failed, assuming KV version 1", "path", path, "error", err)
+		return kvMount{version: 1}
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil || secret == nil || secret.Data == nil {
+		l.Debugw("unexpected mount lookup response, assuming KV version 1", "path", path)
+		return kvMount{version: 1}
+	}
+	mount := kvMount{version: 1}
+	mount.path, _ = secret.Data["path"].(string)
+	if options, ok := secret.Data["options"].(map[string]interface{}); ok {
+		if v, ok := options["version"].(string); ok && v == "2" {
+			mount.version = 2
+		}
+	}
+	return mount
+}
+
+// ReadSecret reads the fields of a secret. KV version 2 mounts are detected
+// and read transparently. When the reference names a field, only that field
+// is returned.
+func ReadSecret(ctx context.Context, client *api.Client, ref SecretRef, l *zap.SugaredLogger) (map[string]string, error) {
+	mount := lookupMount(ctx, client, ref.Path, l)
+	path := ref.Path
+	if mount.version == 2 {
+		path = mount.path + "data/" + strings.TrimPrefix(ref.Path, mount.path)
+	} else if ref.Version != 0 {
+		return nil, fmt.Errorf("%s: versions are only supported by KV version 2 secrets", ref)
+	}
+	r := client.NewRequest("GET", "/v1/"+path)
+	if ref.Version != 0 {
+		r.Params.Set("version", strconv.Itoa(ref.Version))
+	}
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if resp != nil && resp.StatusCode == 404 {
+		return nil, fmt.Errorf("secret not found in Vault: %s", ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret from vault: %s", err)
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret from vault: %s", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("secret not found in Vault: %s", ref)
+	}
+	data := secret.Data
+	if mount.version == 2 {
+		data, _ = secret.Data["data"].(map[string]interface{})
+		if data == nil {
+			// the version was deleted or destroyed
+			return nil, fmt.Errorf("secret not found in Vault: %s", ref)
+		}
+	}
+	l.Debugw("secret read from vault", "key", ref.String(), "kv", mount.version)
+	result := make(map[string]string, len(data))
+	for k, v := range data {
+		if ref.Field != "" && k != ref.Field {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			result[k] = s
+		} else if v != nil {
+			result[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	if ref.Field != "" && len(result) == 0 {
+		return nil, fmt.Errorf("field %s not found in secret %s", ref.Field, ref.Path)
+	}
+	return result, nil
+}
@@ -0,0 +1,40 @@
+package vault
+
+import "testing"
+
+func TestParseSecretRef(t *testing.T) {
+	tests := []struct {
+		s    string
+		want SecretRef
+	}{
+		{s: "secret/db", want: SecretRef{Path: "secret/db"}},
+		{s: "/secret/db/", want: SecretRef{Path: "secret/db"}},
+		{s: "secret/db#password", want: SecretRef{Path: "secret/db", Field: "password"}},
+		{s: "secret/db@3", want: SecretRef{Path: "secret/db", Version: 3}},
+		{s: "secret/db#password@3", want: SecretRef{Path: "secret/db", Field: "password", Version: 3}},
+		{s: "secret/mail#admin@example.org", want: SecretRef{Path: "secret/mail", Field: "admin@example.org"}},
+		{s: "secret/user@host#key", want: SecretRef{Path: "secret/user@host", Field: "key"}},
+		{s: "secret/a#b#c", want: SecretRef{Path: "secret/a#b", Field: "c"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseSecretRef(tt.s)
+		if err != nil {
+			t.Errorf("ParseSecretRef(%q) error: %s", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSecretRef(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+		if again, err := ParseSecretRef(got.String()); err != nil || again != got {
+			t.Errorf("%q does not parse back to %+v", got.String(), got)
+		}
+	}
+}
+
+func TestParseSecretRefErrors(t *testing.T) {
+	for _, s := range []string{"", "/", "#password", "secret/db#", "secret/db#@2", "secret/db@0", "secret/db@-1"} {
+		if _, err := ParseSecretRef(s); err == nil {
+			t.Errorf("ParseSecretRef(%q) was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+)
+
+// Names of the flags that the auth methods may need.
+const (
+	FlagToken    = "vault-token"
+	FlagAuthPath = "vault-auth-path"
+	FlagUsername = "vault-username"
+	FlagPassword = "vault-password"
+	FlagRole     = "vault-auth-role"
+	FlagJWT      = "vault-jwt"
+	FlagJWTFile  = "vault-jwt-file"
+)
+
+// AuthMethod describes a Vault authentication method.
+type AuthMethod struct {
+	// Name of the method, also its default mount path.
+	Name string
+	// Flags lists the flags that the method uses.
+	Flags []string
+	// Login authenticates the client.
+	Login func(ctx context.Context, client *api.Client, vaultParams params.VaultParams, l *zap.SugaredLogger) error
+}
+
+var authMethods = []AuthMethod{
+	{
+		Name:  "token",
+		Flags: []string{FlagToken},
+		Login: tokenLogin,
+	},
+	{
+		Name:  "userpass",
+		Flags: []string{FlagAuthPath, FlagUsername, FlagPassword},
+		Login: userpassLogin,
+	},
+	{
+		Name:  "ldap",
+		Flags: []string{FlagAuthPath, FlagUsername, FlagPassword},
+		Login: userpassLogin,
+	},
+	{
+		Name:  "approle",
+		Flags: []string{FlagAuthPath, FlagUsername, FlagPassword},
+		Login: approleLogin,
+	},
+	{
+		Name:  "jwt",
+		Flags: []string{FlagAuthPath, FlagRole, FlagJWT, FlagJWTFile},
+		Login: jwtLogin,
+	},
+	{
+		Name:  "kubernetes",
+		Flags: []string{FlagAuthPath, FlagRole, FlagJWTFile},
+		Login: kubernetesLogin,
+	},
+	{
+		Name:  "cert",
+		Flags: []string{FlagAuthPath, FlagRole},
+		Login: certLogin,
+	},
+}
+
+// RegisterAuthMethod adds an authentication method, or replaces the method
+// that has the same name.
+func RegisterAuthMethod(method AuthMethod) {
+	for i, m := range authMethods {
+		if m.Name == method.Name {
+			authMethods[i] = method
+			return
+		}
+	}
+	authMethods = append(authMethods, method)
+}
+
+// LookupAuthMethod returns the authentication method called name.
+func LookupAuthMethod(name string) (AuthMethod, bool) {
+	for _, m := range authMethods {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return AuthMethod{}, false
+}
+
+// AuthMethodNames returns the names of the registered authentication methods.
+func AuthMethodNames() []string {
+	names := make([]string, 0, len(authMethods))
+	for _, m := range authMethods {
+		names = append(names, m.Name)
+	}
+	return names
+}
@@ -0,0 +1,321 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/vault/api"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stephane-martin/vssh/params"
+	"go.uber.org/zap"
+)
+
+// renewBefore is the remaining TTL under which a reused token gets renewed.
+const renewBefore = 10 * time.Minute
+
+// TokenHelper stores the Vault token between vssh invocations, like the
+// token helpers of the Vault CLI.
+type TokenHelper interface {
+	Get() (string, error)
+	Store(token string) error
+	Erase() error
+}
+
+// NewTokenHelper returns the token helper that runs program, or the helper
+// configured in the Vault CLI configuration file. When there is none, the
+// token is stored in ~/.vault-token.
+func NewTokenHelper(program string) (TokenHelper, error) {
+	if program == "" {
+		var err error
+		program, err = configuredTokenHelper()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if program != "" {
+		program, err := homedir.Expand(program)
+		if err != nil {
+			return nil, err
+		}
+		return externalTokenHelper{program: program}, nil
+	}
+	path, err := homedir.Expand("~/.vault-token")
+	if err != nil {
+		return nil, err
+	}
+	return fileTokenHelper{path: path}, nil
+}
+
+// configuredTokenHelper reads the token_helper setting of the Vault CLI
+// configuration file.
+func configuredTokenHelper() (string, error) {
+	path := os.Getenv("VAULT_CONFIG_PATH")
+	if path == "" {
+		path = "~/.vault"
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		TokenHelper string `hcl:"token_helper"`
+	}
+	err = hcl.Decode(&config, string(content))
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return config.TokenHelper, nil
+}
+
+type fileTokenHelper struct {
+	path string
+}
+
+func (h fileTokenHelper) Get() (string, error) {
+	content, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (h fileTokenHelper) Store(token string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), ".vault-token")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(token)
+	_ = tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (h fileTokenHelper) Erase() error {
+	err := os.Remove(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// externalTokenHelper runs a token helper program with the get, store or
+// erase argument. The token is passed on stdin and read from stdout.
+type externalTokenHelper struct {
+	program string
+}
+
+func (h externalTokenHelper) run(arg string, stdin []byte) ([]byte, error) {
+	cmd := exec.Command(h.program, arg)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("token helper %s %s failed: %s: %s", h.program, arg, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (h externalTokenHelper) Get() (string, error) {
+	out, err := h.run("get", nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (h externalTokenHelper) Store(token string) error {
+	_, err := h.run("store", []byte(token))
+	return err
+}
+
+func (h externalTokenHelper) Erase() error {
+	_, err := h.run("erase", nil)
+	return err
+}
+
+// TokenOrigin is where a stored token was obtained. A stored token is only
+// reused with the same Vault server, namespace and auth method.
+type TokenOrigin struct {
+	Address    string `json:"address"`
+	Namespace  string `json:"namespace"`
+	AuthMethod string `json:"auth_method"`
+	AuthPath   string `json:"auth_path"`
+	// Token is the SHA-256 of the token, so that the origin of a token that
+	// was replaced by another tool is not taken for the origin of the new one.
+	Token string `json:"token"`
+}
+
+// NewTokenOrigin returns the origin of the tokens obtained with vaultParams.
+func NewTokenOrigin(vaultParams params.VaultParams) TokenOrigin {
+	return TokenOrigin{
+		Address:    strings.TrimRight(vaultParams.Address, "/"),
+		Namespace:  strings.Trim(vaultParams.Namespace, "/"),
+		AuthMethod: vaultParams.AuthMethod,
+		AuthPath:   strings.Trim(vaultParams.AuthPath, "/"),
+	}
+}
+
+func (o TokenOrigin) withToken(token string) TokenOrigin {
+	sum := sha256.Sum256([]byte(token))
+	o.Token = hex.EncodeToString(sum[:])
+	return o
+}
+
+func tokenOriginPath() (string, error) {
+	return homedir.Expand("~/.cache/vssh/vault-token-origin.json")
+}
+
+// StoreToken stores the token with the token helper, and records its origin.
+func StoreToken(helper TokenHelper, token string, origin TokenOrigin) error {
+	err := helper.Store(token)
+	if err != nil {
+		return err
+	}
+	path, err := tokenOriginPath()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(origin.withToken(token))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+// storedTokenOrigin returns the recorded origin of the stored token.
+func storedTokenOrigin() (TokenOrigin, error) {
+	var origin TokenOrigin
+	path, err := tokenOriginPath()
+	if err != nil {
+		return origin, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return origin, nil
+	}
+	if err != nil {
+		return origin, err
+	}
+	err = json.Unmarshal(content, &origin)
+	return origin, err
+}
+
+// ReuseToken sets the client token to the stored token, if it was obtained
+// from the same origin and is still valid. The token is renewed when it is
+// renewable and close to expiry.
+func ReuseToken(ctx context.Context, client *api.Client, helper TokenHelper, origin TokenOrigin, l *zap.SugaredLogger) bool {
+	token, err := helper.Get()
+	if err != nil {
+		l.Infow("failed to get the stored Vault token", "error", err)
+		return false
+	}
+	if token == "" {
+		return false
+	}
+	stored, err := storedTokenOrigin()
+	if err != nil {
+		l.Infow("failed to read the origin of the stored Vault token", "error", err)
+		return false
+	}
+	if stored != origin.withToken(token) {
+		l.Debugw("stored Vault token was obtained elsewhere", "address", stored.Address, "namespace", stored.Namespace, "method", stored.AuthMethod)
+		return false
+	}
+	client.SetToken(token)
+	_, err = RenewToken(ctx, client, l)
+	if err != nil {
+		l.Debugw("stored Vault token is not usable", "error", err)
+		client.ClearToken()
+		return false
+	}
+	l.Debug("reusing the stored Vault token")
+	return true
+}
+
+// RenewToken checks that the client token is valid, and renews it when it is
+// renewable and close to expiry. It returns the remaining TTL of the token,
+// or 0 when the token never expires.
+func RenewToken(ctx context.Context, client *api.Client, l *zap.SugaredLogger) (time.Duration, error) {
+	secret, err := tokenRequest(ctx, client, client.NewRequest("GET", "/v1/auth/token/lookup-self"))
+	if err != nil {
+		return 0, err
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return 0, err
+	}
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return 0, err
+	}
+	if ttl == 0 || ttl > renewBefore || !renewable {
+		// a zero TTL means that the token never expires
+		return ttl, nil
+	}
+	r := client.NewRequest("PUT", "/v1/auth/token/renew-self")
+	err = r.SetJSONBody(map[string]interface{}{})
+	if err != nil {
+		return 0, err
+	}
+	secret, err = tokenRequest(ctx, client, r)
+	if err != nil {
+		l.Errorw("failed to renew the Vault token", "ttl", ttl, "error", err)
+		return ttl, fmt.Errorf("failed to renew the Vault token: %s", err)
+	}
+	if secret.Auth != nil {
+		l.Debugw("Vault token renewed", "lease", secret.Auth.LeaseDuration)
+		ttl = time.Duration(secret.Auth.LeaseDuration) * time.Second
+	}
+	return ttl, nil
+}
+
+func tokenRequest(ctx context.Context, client *api.Client, r *api.Request) (*api.Secret, error) {
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer func() { _ = resp.Body.Close() }()
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("empty response from Vault")
+	}
+	return secret, nil
+}
@@ -3,7 +3,6 @@ package vault
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"github.com/awnumar/memguard"
 	"github.com/stephane-martin/vssh/params"
@@ -15,60 +14,110 @@ import (
 	"go.uber.org/zap"
 )
 
+// GetSecretsFromVault reads the secrets referenced by keys, and returns their
+// fields as environment variables.
 func GetSecretsFromVault(ctx context.Context, client *api.Client, keys []string, prefix, upcase bool, l *zap.SugaredLogger) (map[string]string, error) {
-	c := make(chan map[string]string, 1)
-	var err error
-	lCtx, lCancel := context.WithCancel(ctx)
-	go func() {
-		err = vexec.GetSecrets(
-			lCtx,
-			client,
-			prefix, upcase, true,
-			keys,
-			l,
-			c,
-		)
-		close(c)
-	}()
-	secrets := <-c
-	lCancel()
-	return secrets, err
+	result := make(map[string]string)
+	for _, key := range keys {
+		ref, err := ParseSecretRef(key)
+		if err != nil {
+			return nil, err
+		}
+		values, err := ReadSecret(ctx, client, ref, l)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			if prefix {
+				k = ref.Path + "_" + k
+			}
+			k = vexec.Sanitize(k)
+			if upcase {
+				k = strings.ToUpper(k)
+			}
+			result[k] = v
+		}
+	}
+	return result, nil
 }
 
+// ReadPrivateKeyFromVault reads a SSH private key stored in Vault. The key is
+// taken from the field named in vpath. Without a field, the secret must have a
+// single field, or a field called private_key.
 func ReadPrivateKeyFromVault(ctx context.Context, vpath string, client *api.Client, l *zap.SugaredLogger) (*memguard.LockedBuffer, error) {
-	m, err := GetSecretsFromVault(ctx, client, []string{vpath}, false, false, l)
+	v, err := ReadSecretValue(ctx, client, vpath, privateKeyField, l)
+	if err != nil {
+		return nil, err
+	}
+	privkeyb := []byte(v)
+	privkeyb2 := append(bytes.Trim(privkeyb, "\n"), '\n')
+	privkey, err := memguard.NewImmutableFromBytes(privkeyb2)
+	memguard.WipeBytes(privkeyb)
 	if err != nil {
 		return nil, err
 	}
+	return privkey, nil
+}
+
+// privateKeyField is the default field name of private keys stored in Vault.
+const privateKeyField = "private_key"
+
+// ReadSecretValue reads the value of a single field of a secret. The field is
+// the one named in the reference. Without a field, the secret must have a
+// single field, or a field called defaultField.
+func ReadSecretValue(ctx context.Context, client *api.Client, reference, defaultField string, l *zap.SugaredLogger) (string, error) {
+	ref, err := ParseSecretRef(reference)
+	if err != nil {
+		return "", err
+	}
+	m, err := ReadSecret(ctx, client, ref, l)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := m[defaultField]; ok && ref.Field == "" {
+		return v, nil
+	}
+	if len(m) > 1 {
+		return "", fmt.Errorf("several fields in %s: specify the field as %s#field", ref.Path, ref.Path)
+	}
 	for _, v := range m {
-		privkeyb := []byte(v)
-		privkeyb2 := append(bytes.Trim(privkeyb, "\n"), '\n')
-		privkey, err := memguard.NewImmutableFromBytes(privkeyb2)
-		memguard.WipeBytes(privkeyb)
-		if err != nil {
-			return nil, err
-		}
-		return privkey, nil
+		return v, nil
 	}
-	return nil, errors.New("private key not found in Vault")
+	return "", fmt.Errorf("empty secret in Vault: %s", ref)
 }
 
 func GetVaultClient(ctx context.Context, vaultParams params.VaultParams, l *zap.SugaredLogger) (*api.Client, error) {
 	// unset env VAULT_ADDR to prevent the vault client from seeing it
 	_ = os.Unsetenv("VAULT_ADDR")
 
-	client, err := vexec.Auth(
-		ctx,
-		vaultParams.AuthMethod,
-		vaultParams.Address,
-		vaultParams.AuthPath,
-		vaultParams.Token,
-		vaultParams.Username,
-		vaultParams.Password,
-		l,
-	)
+	client, err := NewClient(vaultParams)
 	if err != nil {
-		return nil, fmt.Errorf("Vault auth failed: %s", err)
+		return nil, err
+	}
+	helper, err := NewTokenHelper(vaultParams.TokenHelper)
+	if err != nil {
+		return nil, fmt.Errorf("Vault token helper error: %s", err)
+	}
+	if vaultParams.AuthMethod == "token" && vaultParams.Token != "" {
+		client.SetToken(vaultParams.Token)
+		_, err = RenewToken(ctx, client, l)
+		if err != nil {
+			l.Infow("failed to look up the Vault token", "error", err)
+		}
+	} else if origin := NewTokenOrigin(vaultParams); !ReuseToken(ctx, client, helper, origin, l) {
+		err = Auth(ctx, client, vaultParams, l)
+		if err == context.Canceled {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Vault auth failed: %s", err)
+		}
+		if vaultParams.AuthMethod != "token" {
+			err = StoreToken(helper, client.Token(), origin)
+			if err != nil {
+				l.Infow("failed to store the Vault token", "error", err)
+			}
+		}
 	}
 	err = vexec.CheckHealth(ctx, client)
 	if err != nil {
@@ -79,21 +128,35 @@ func GetVaultClient(ctx context.Context, vaultParams params.VaultParams, l *zap.
 
 func GetVaultParams(c params.CLIContext) params.VaultParams {
 	p := params.VaultParams{
-		SSHMount:   c.VaultSSHMount(),
-		SSHRole:    c.VaultSSHRole(),
-		AuthMethod: strings.ToLower(c.VaultAuthMethod()),
-		AuthPath:   c.VaultAuthPath(),
-		Address:    c.VaultAddress(),
-		Token:      c.VaultToken(),
-		Username:   c.VaultUsername(),
-		Password:   c.VaultPassword(),
+		SSHMount:      c.VaultSSHMount(),
+		SSHRole:       c.VaultSSHRole(),
+		SSHHostMount:  strings.Trim(c.VaultSSHHostMount(), "/"),
+		AuthMethod:    strings.ToLower(c.VaultAuthMethod()),
+		AuthPath:      c.VaultAuthPath(),
+		Address:       c.VaultAddress(),
+		Token:         c.VaultToken(),
+		Username:      c.VaultUsername(),
+		Password:      c.VaultPassword(),
+		CACert:        c.VaultCACert(),
+		ClientCert:    c.VaultClientCert(),
+		ClientKey:     c.VaultClientKey(),
+		TLSSkipVerify: c.VaultTLSSkipVerify(),
+		Namespace:     strings.Trim(c.VaultNamespace(), "/"),
+		Role:          c.VaultAuthRole(),
+		JWT:           c.VaultJWT(),
+		JWTFile:       c.VaultJWTFile(),
+		TokenHelper:   c.VaultTokenHelper(),
+		OTPMount:      strings.Trim(c.VaultOTPMount(), "/"),
+		OTPRole:       c.VaultOTPRole(),
 	}
 	if p.AuthMethod == "" {
 		p.AuthMethod = "token"
 	}
+	if p.OTPMount == "" {
+		p.OTPMount = p.SSHMount
+	}
 	if p.AuthPath == "" {
 		p.AuthPath = p.AuthMethod
 	}
 	return p
 }
-
@@ -3,24 +3,22 @@ package widgets
 import (
 	"errors"
 	"fmt"
-	"os/user"
 	"strconv"
 	"strings"
 
 	"github.com/stephane-martin/vssh/params"
+	"github.com/stephane-martin/vssh/vault"
 
 	"github.com/mattn/go-shellwords"
 	"github.com/rivo/tview"
 )
 
-var authMethods = []string{"token", "userpass", "ldap", "approle"}
-
 func t(s string) string {
 	return strings.TrimSpace(s)
 }
 
-func idx(m string) int {
-	for i, other := range authMethods {
+func idx(choices []string, m string) int {
+	for i, other := range choices {
 		if m == other {
 			return i
 		}
@@ -39,23 +37,25 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 	form.SetButtonTextColor(tview.Styles.PrimaryTextColor)
 	form.SetCancelFunc(func() { app.Stop() })
 
-	addInputField := func(label, value string, fieldWidth int, accept func(textToCheck string, lastChar rune) bool) *tview.InputField {
-		field := tview.NewInputField().
+	newInputField := func(label, value string, fieldWidth int, accept func(textToCheck string, lastChar rune) bool) *tview.InputField {
+		return tview.NewInputField().
 			SetLabel(label).
 			SetText(value).
 			SetFieldWidth(fieldWidth).
 			SetAcceptanceFunc(accept)
+	}
+
+	addInputField := func(label, value string, fieldWidth int, accept func(textToCheck string, lastChar rune) bool) *tview.InputField {
+		field := newInputField(label, value, fieldWidth, accept)
 		form.AddFormItem(field)
 		return field
 	}
 
-	addPasswordField := func(label string) *tview.InputField {
-		field := tview.NewInputField().
+	newPasswordField := func(label string) *tview.InputField {
+		return tview.NewInputField().
 			SetLabel(label).
 			SetFieldWidth(32).
 			SetMaskCharacter('*')
-		form.AddFormItem(field)
-		return field
 	}
 
 	addCheckBox := func(label string, checked bool) *tview.Checkbox {
@@ -70,34 +70,29 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 		field := tview.NewDropDown().
 			SetLabel(label).
 			SetOptions(choices, nil)
-		field.SetCurrentOption(idx(init))
+		field.SetCurrentOption(idx(choices, init))
 		form.AddFormItem(field)
 		return field
 	}
 
-	ctx := new(formContext)
+	ctx := &formContext{CLIContext: c}
 
-	login := c.SSHLogin()
-	if login == "" {
-		u, err := user.Current()
-		if err == nil {
-			login = u.Username
-		}
-	}
-
-	pkeyPath := c.PrivateKey()
-	if pkeyPath == "" {
-		pkeyPath = "~/.ssh/id_rsa"
-	}
+	pkeyPath := strings.Join(c.PrivateKeys(), ",")
 
 	ctx.sshHostField = addInputField("SSH host", c.SSHHost(), 40, nil)
-	ctx.sshPortField = addInputField("SSH port", fmt.Sprintf("%d", c.SSHPort()), 5, tview.InputFieldInteger)
-	ctx.sshLoginField = addInputField("SSH login", login, 40, nil)
+	// an empty port or login is resolved through ssh_config
+	port := ""
+	if c.SSHPort() != 0 {
+		port = fmt.Sprintf("%d", c.SSHPort())
+	}
+	ctx.sshPortField = addInputField("SSH port", port, 5, tview.InputFieldInteger)
+	ctx.sshLoginField = addInputField("SSH login", c.SSHLogin(), 40, nil)
 	if sshOptions {
 		ctx.remoteCommandField = addInputField("Remote command", "", 40, nil)
 	}
-	ctx.sshPKeyField = addInputField("SSH private key path", pkeyPath, 40, nil)
+	ctx.sshPKeyField = addInputField("SSH private key paths", pkeyPath, 40, nil)
 	ctx.sshVPKeyField = addInputField("SSH private key path in Vault", c.VPrivateKey(), 40, nil)
+	ctx.ephemeralField = addCheckBox("Use an ephemeral key", c.Ephemeral())
 	ctx.sshPasswordField = addCheckBox("Use SSH password", c.SSHPassword())
 	ctx.sshAgentField = addCheckBox("Use SSH agent", c.SSHAgent())
 	ctx.insecureField = addCheckBox("Do not check host key", c.SSHInsecure())
@@ -106,13 +101,55 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 	}
 	ctx.httpProxyField = addInputField("HTTP proxy", c.HTTPProxy(), 40, nil)
 	ctx.vaultURLField = addInputField("Vault URL", c.VaultAddress(), 40, nil)
-	ctx.vaultAuthMethodField = addDropDown("Vault authentication method", authMethods, c.VaultAuthMethod())
-	ctx.vaultAuthPathField = addInputField("Vault authentication path", c.VaultAuthPath(), 40, nil)
-	ctx.vaultTokenField = addInputField("Vault token", c.VaultToken(), 32, nil)
-	ctx.vaultUsernameField = addInputField("Vault username", c.VaultUsername(), 40, nil)
-	ctx.vaultPassField = addPasswordField("Vault password")
-	ctx.vaultSSHMountField = addInputField("Vault SSH mount point", c.VaultSSHMount(), 40, nil)
-	ctx.vaultSSHRoleField = addInputField("Vault SSH role", c.VaultSSHRole(), 40, nil)
+	ctx.vaultAuthMethodField = addDropDown("Vault authentication method", vault.AuthMethodNames(), c.VaultAuthMethod())
+	methodIndex := form.GetFormItemIndex(ctx.vaultAuthMethodField.GetLabel())
+
+	// the fields below the authentication method are added by showAuthFields,
+	// depending on the flags that the chosen method uses
+	ctx.vaultAuthPathField = newInputField("Vault authentication path", c.VaultAuthPath(), 40, nil)
+	ctx.vaultTokenField = newInputField("Vault token", c.VaultToken(), 32, nil)
+	ctx.vaultUsernameField = newInputField("Vault username", c.VaultUsername(), 40, nil)
+	ctx.vaultPassField = newPasswordField("Vault password")
+	ctx.vaultAuthRoleField = newInputField("Vault authentication role", c.VaultAuthRole(), 40, nil)
+	ctx.vaultJWTField = newInputField("Vault JWT", c.VaultJWT(), 40, nil)
+	ctx.vaultJWTFileField = newInputField("Vault JWT file", c.VaultJWTFile(), 40, nil)
+	ctx.vaultSSHMountField = newInputField("Vault SSH mount point", c.VaultSSHMount(), 40, nil)
+	ctx.vaultSSHRoleField = newInputField("Vault SSH role", c.VaultSSHRole(), 40, nil)
+	ctx.vaultSSHHostMountField = newInputField("Vault SSH host signer mount point", c.VaultSSHHostMount(), 40, nil)
+
+	authFields := map[string]tview.FormItem{
+		vault.FlagToken:    ctx.vaultTokenField,
+		vault.FlagAuthPath: ctx.vaultAuthPathField,
+		vault.FlagUsername: ctx.vaultUsernameField,
+		vault.FlagPassword: ctx.vaultPassField,
+		vault.FlagRole:     ctx.vaultAuthRoleField,
+		vault.FlagJWT:      ctx.vaultJWTField,
+		vault.FlagJWTFile:  ctx.vaultJWTFileField,
+	}
+	trailingFields := []tview.FormItem{ctx.vaultSSHMountField, ctx.vaultSSHRoleField, ctx.vaultSSHHostMountField}
+	var shown int
+
+	showAuthFields := func(name string) {
+		for ; shown > 0; shown-- {
+			form.RemoveFormItem(methodIndex + 1)
+		}
+		if method, ok := vault.LookupAuthMethod(name); ok {
+			for _, flag := range method.Flags {
+				if field, ok := authFields[flag]; ok {
+					form.AddFormItem(field)
+					shown++
+				}
+			}
+		}
+		for _, field := range trailingFields {
+			form.AddFormItem(field)
+			shown++
+		}
+	}
+	showAuthFields(ctx.VaultAuthMethod())
+	ctx.vaultAuthMethodField.SetSelectedFunc(func(text string, index int) {
+		showAuthFields(text)
+	})
 
 	var confirm bool
 
@@ -138,12 +175,6 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 				}
 			}
 		}
-		port := t(ctx.sshPortField.GetText())
-		if port == "" {
-			app.SetFocus(ctx.sshPortField)
-			return
-		}
-
 		confirm = true
 		app.Stop()
 	})
@@ -167,25 +198,31 @@ func Form(c params.CLIContext, sshOptions bool) (params.CLIContext, error) {
 }
 
 type formContext struct {
-	sshHostField         *tview.InputField
-	sshPortField         *tview.InputField
-	sshLoginField        *tview.InputField
-	sshPasswordField     *tview.Checkbox
-	sshAgentField        *tview.Checkbox
-	sshPKeyField         *tview.InputField
-	sshVPKeyField        *tview.InputField
-	insecureField        *tview.Checkbox
-	httpProxyField       *tview.InputField
-	forceTerminalField   *tview.Checkbox
-	remoteCommandField   *tview.InputField
-	vaultURLField        *tview.InputField
-	vaultAuthMethodField *tview.DropDown
-	vaultAuthPathField   *tview.InputField
-	vaultTokenField      *tview.InputField
-	vaultUsernameField   *tview.InputField
-	vaultPassField       *tview.InputField
-	vaultSSHMountField   *tview.InputField
-	vaultSSHRoleField    *tview.InputField
+	params.CLIContext
+	sshHostField           *tview.InputField
+	sshPortField           *tview.InputField
+	sshLoginField          *tview.InputField
+	sshPasswordField       *tview.Checkbox
+	sshAgentField          *tview.Checkbox
+	sshPKeyField           *tview.InputField
+	sshVPKeyField          *tview.InputField
+	ephemeralField         *tview.Checkbox
+	insecureField          *tview.Checkbox
+	httpProxyField         *tview.InputField
+	forceTerminalField     *tview.Checkbox
+	remoteCommandField     *tview.InputField
+	vaultURLField          *tview.InputField
+	vaultAuthMethodField   *tview.DropDown
+	vaultAuthPathField     *tview.InputField
+	vaultTokenField        *tview.InputField
+	vaultUsernameField     *tview.InputField
+	vaultPassField         *tview.InputField
+	vaultAuthRoleField     *tview.InputField
+	vaultJWTField          *tview.InputField
+	vaultJWTFileField      *tview.InputField
+	vaultSSHMountField     *tview.InputField
+	vaultSSHRoleField      *tview.InputField
+	vaultSSHHostMountField *tview.InputField
 }
 
 func (ctx *formContext) VaultAddress() string {
@@ -216,6 +253,18 @@ func (ctx *formContext) VaultPassword() string {
 	return t(ctx.vaultPassField.GetText())
 }
 
+func (ctx *formContext) VaultAuthRole() string {
+	return t(ctx.vaultAuthRoleField.GetText())
+}
+
+func (ctx *formContext) VaultJWT() string {
+	return t(ctx.vaultJWTField.GetText())
+}
+
+func (ctx *formContext) VaultJWTFile() string {
+	return t(ctx.vaultJWTFileField.GetText())
+}
+
 func (ctx *formContext) VaultSSHMount() string {
 	return t(ctx.vaultSSHMountField.GetText())
 }
@@ -224,6 +273,10 @@ func (ctx *formContext) VaultSSHRole() string {
 	return t(ctx.vaultSSHRoleField.GetText())
 }
 
+func (ctx *formContext) VaultSSHHostMount() string {
+	return t(ctx.vaultSSHHostMountField.GetText())
+}
+
 func (ctx *formContext) SSHCommand() []string {
 	if ctx.remoteCommandField == nil {
 		return nil
@@ -243,6 +296,10 @@ func (ctx *formContext) SSHCommand() []string {
 	return args
 }
 
+func (ctx *formContext) SSHOptions() []string {
+	return nil
+}
+
 func (ctx *formContext) SSHHost() string {
 	return t(ctx.sshHostField.GetText())
 }
@@ -280,10 +337,20 @@ func (ctx *formContext) ForceTerminal() bool {
 	return false
 }
 
-func (ctx *formContext) PrivateKey() string {
-	return t(ctx.sshPKeyField.GetText())
+func (ctx *formContext) PrivateKeys() []string {
+	var paths []string
+	for _, p := range strings.Split(ctx.sshPKeyField.GetText(), ",") {
+		if p = t(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
 }
 
 func (ctx *formContext) VPrivateKey() string {
 	return t(ctx.sshVPKeyField.GetText())
 }
+
+func (ctx *formContext) Ephemeral() bool {
+	return ctx.ephemeralField.IsChecked()
+}